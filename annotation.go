@@ -0,0 +1,219 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"models"
+	"usage"
+)
+
+// maxAnnotationLength is the longest an annotation can be, which lets queryAnnotations find all
+// annotations overlapping a range by their start.
+const maxAnnotationLength = 24 * time.Hour
+
+func init() {
+	http.HandleFunc("/annotations/", annotationsHandler)
+	http.HandleFunc("/admin/annotations/", editAnnotationHandler)
+}
+
+// AnnotationJSON is an annotation as returned by /annotations/.
+type AnnotationJSON struct {
+	ID       int64     `json:"id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Label    string    `json:"label"`
+	Category string    `json:"category"`
+}
+
+// annotationsHandler lists the annotations in a date range as JSON.
+func annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := parseDateRange(r, loc, 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	annotations, keys, err := queryAnnotations(c, from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query annotations: %v", err), http.StatusInternalServerError)
+		return
+	}
+	result := []AnnotationJSON{}
+	for i, annotation := range annotations {
+		result = append(result, annotationJSON(keys[i], annotation))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		c.Errorf("Failed to write annotations: %v", err)
+	}
+}
+
+// editAnnotationHandler creates an annotation, or with id, updates it, or with id and delete,
+// deletes it. Start and end are Unix timestamps in seconds or datetime-local values. Afterwards it
+// redirects to redirect if given, and otherwise responds with the annotation.
+func editAnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		http.Error(w, "Editing annotations requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var key *datastore.Key
+	var annotation models.Annotation
+	if r.FormValue("id") != "" {
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid id %q", r.FormValue("id")), http.StatusBadRequest)
+			return
+		}
+		key = datastore.NewKey(c, "Annotation", "", id, nil)
+		if err := datastore.Get(c, key, &annotation); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get annotation %d: %v", id, err), http.StatusNotFound)
+			return
+		}
+
+		if r.FormValue("delete") != "" {
+			if err := datastore.Delete(c, key); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to delete annotation %d: %v", id, err), http.StatusInternalServerError)
+				return
+			}
+			annotationResponse(w, r, key, annotation)
+			return
+		}
+	} else {
+		annotation.Created = time.Now()
+		key = datastore.NewIncompleteKey(c, "Annotation", nil)
+	}
+
+	if r.FormValue("start") != "" {
+		if annotation.Start, err = parseAnnotationTime(r.FormValue("start"), loc); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse start: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if r.FormValue("end") != "" {
+		if annotation.End, err = parseAnnotationTime(r.FormValue("end"), loc); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse end: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.Form["label"]; ok {
+		annotation.Label = strings.TrimSpace(r.FormValue("label"))
+	}
+	if _, ok := r.Form["category"]; ok {
+		annotation.Category = strings.Trim(strings.TrimSpace(r.FormValue("category")), "/")
+	}
+	if !annotation.End.After(annotation.Start) {
+		http.Error(w, "Annotations must end after they start", http.StatusBadRequest)
+		return
+	}
+	if annotation.End.Sub(annotation.Start) > maxAnnotationLength {
+		http.Error(w, fmt.Sprintf("Annotations can't be longer than %v", maxAnnotationLength), http.StatusBadRequest)
+		return
+	}
+	if annotation.Label == "" && annotation.Category == "" {
+		http.Error(w, "Annotations need a label or a category", http.StatusBadRequest)
+		return
+	}
+
+	if key, err = datastore.Put(c, key, &annotation); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save annotation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	annotationResponse(w, r, key, annotation)
+}
+
+func annotationResponse(w http.ResponseWriter, r *http.Request, key *datastore.Key, annotation models.Annotation) {
+	// Only redirect within the app.
+	if redirect := r.FormValue("redirect"); strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotationJSON(key, annotation))
+}
+
+func annotationJSON(key *datastore.Key, annotation models.Annotation) AnnotationJSON {
+	return AnnotationJSON{
+		ID:       key.IntID(),
+		Start:    annotation.Start,
+		End:      annotation.End,
+		Label:    annotation.Label,
+		Category: annotation.Category,
+	}
+}
+
+func parseAnnotationTime(value string, loc *time.Location) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, _, err := parseDateOrTime(value, loc)
+	return t, err
+}
+
+// queryAnnotations returns all annotations overlapping [from, to) and their keys.
+func queryAnnotations(c appengine.Context, from, to time.Time) ([]models.Annotation, []*datastore.Key, error) {
+	q := datastore.NewQuery("Annotation").
+		Filter("Start >=", from.Add(-maxAnnotationLength)).
+		Filter("Start <", to).
+		Order("Start")
+	var annotations []models.Annotation
+	keys, err := q.GetAll(c, &annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+	var overlapping []models.Annotation
+	var overlappingKeys []*datastore.Key
+	for i, annotation := range annotations {
+		if annotation.End.After(from) {
+			overlapping = append(overlapping, annotation)
+			overlappingKeys = append(overlappingKeys, keys[i])
+		}
+	}
+	return overlapping, overlappingKeys, nil
+}
+
+// annotationSpan returns a span for annotation, which loggers attribute to the annotations node of
+// the tree, below its category and label, e.g. annotations/reading/papers/Spanner paper.
+func annotationSpan(annotation models.Annotation) models.Span {
+	return models.Span{
+		Start:    annotation.Start,
+		End:      annotation.End,
+		Hostname: usage.AnnotationHostname,
+		Focused:  models.App{Process: annotation.Category, WindowTitle: annotation.Label},
+	}
+}
+
+// annotationLogger drops the parts of spans that were annotated, since annotations say what was
+// really done during that time.
+type annotationLogger struct {
+	usage.Logger
+	annotated []period // Sorted and not overlapping
+}
+
+func (l *annotationLogger) AddSpan(span models.Span) {
+	for _, p := range subtract(period{span.Start, span.End}, l.annotated) {
+		span.Start, span.End = p.Start, p.End
+		l.Logger.AddSpan(span)
+	}
+}
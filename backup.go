@@ -0,0 +1,278 @@
+package usage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"common"
+	"models"
+)
+
+// backupVersion is the version of the backup format written by backupHandler. restoreHandler reads
+// all versions up to and including it, and rejects newer ones before restoring anything since they
+// can contain kinds or fields it doesn't know about. Bump it whenever either changes. Version 1
+// has HourlyUsage with Events, Piece and Tube, version 2 HourlyUsage with Spans and HostClock,
+// version 3 adds Meeting, Annotation, RuleSet, RepoIndex, Commit, SilentDevice and BudgetAlert, and
+// version 4 records the integer IDs of keys, which annotations need since they are allocated, and
+// adds SentDigest.
+const backupVersion = 4
+
+// restoreBatchSize is the number of pieces or tube journeys that are saved at once while restoring.
+const restoreBatchSize = 100
+
+func init() {
+	http.HandleFunc("/admin/backup/", backupHandler)
+	http.HandleFunc("/admin/restore/", restoreHandler)
+}
+
+// A backup is a gzipped stream of JSON lines: a backupHeader followed by one backupRecord per
+// entity.
+type backupHeader struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type backupRecord struct {
+	Kind   string          `json:"kind"`
+	ID     int64           `json:"id,omitempty"` // Integer ID of the key, if it has one
+	Entity json.RawMessage `json:"entity"`
+}
+
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=app-usage-%s.jsonl.gz", time.Now().Format("2006-01-02")))
+	gz := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gz)
+
+	if err := encoder.Encode(backupHeader{Version: backupVersion, Created: time.Now()}); err != nil {
+		c.Errorf("Failed to write backup: %v", err)
+		return
+	}
+	err := backupKind(c, encoder, "HourlyUsage", "At", func() interface{} { return &models.HourlyUsage{} })
+	if err == nil {
+		err = backupKind(c, encoder, "Piece", "Start", func() interface{} { return &models.Piece{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "Tube", "Start", func() interface{} { return &models.Tube{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "Meeting", "Start", func() interface{} { return &models.Meeting{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "Annotation", "Start", func() interface{} { return &models.Annotation{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "RuleSet", "Version", func() interface{} { return &models.RuleSet{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "RepoIndex", "Hostname", func() interface{} { return &models.RepoIndex{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "Commit", "Time", func() interface{} { return &models.Commit{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "HostClock", "Hostname", func() interface{} { return &models.HostClock{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "SilentDevice", "Device", func() interface{} { return &models.SilentDevice{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "BudgetAlert", "Day", func() interface{} { return &models.BudgetAlert{} })
+	}
+	if err == nil {
+		err = backupKind(c, encoder, "SentDigest", "From", func() interface{} { return &models.SentDigest{} })
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		c.Errorf("Failed to write backup: %v", err)
+	}
+}
+
+// backupKind writes all entities of the given kind, ordered by the given property.
+func backupKind(c appengine.Context, encoder *json.Encoder, kind, order string, newEntity func() interface{}) error {
+	it := datastore.NewQuery(kind).Order(order).Run(c)
+	for {
+		entity := newEntity()
+		key, err := it.Next(entity)
+		if err == datastore.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to query %s: %v", kind, err)
+		}
+
+		data, err := json.Marshal(entity)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal %s: %v", kind, err)
+		}
+		if err := encoder.Encode(backupRecord{Kind: kind, ID: key.IntID(), Entity: data}); err != nil {
+			return err
+		}
+	}
+}
+
+// restoreHandler imports a backup written by backupHandler. Restoring is idempotent: usage is
+// merged into existing hours with the same deduplication as /log/, and pieces and tube journeys
+// are keyed by their start just like when they're first saved.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		http.Error(w, "Restoring requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buffered := bufio.NewReader(r.Body)
+	var body io.Reader = buffered
+	// Accept both compressed and uncompressed backups.
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decompress backup: %v", err), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	decoder := json.NewDecoder(body)
+
+	var header backupHeader
+	if err := decoder.Decode(&header); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read backup header: %v", err), http.StatusBadRequest)
+		return
+	}
+	if header.Version < 1 || header.Version > backupVersion {
+		http.Error(w, fmt.Sprintf("Unsupported backup version %d", header.Version), http.StatusBadRequest)
+		return
+	}
+
+	counts := make(map[string]int)
+	var pieceKeys, tubeKeys []*datastore.Key
+	var pieces []*models.Piece
+	var tubes []*models.Tube
+	flush := func(force bool) error {
+		if len(pieces) > 0 && (force || len(pieces) >= restoreBatchSize) {
+			if _, err := datastore.PutMulti(c, pieceKeys, pieces); err != nil {
+				return fmt.Errorf("Failed to save pieces: %v", err)
+			}
+			pieceKeys, pieces = nil, nil
+		}
+		if len(tubes) > 0 && (force || len(tubes) >= restoreBatchSize) {
+			if _, err := datastore.PutMulti(c, tubeKeys, tubes); err != nil {
+				return fmt.Errorf("Failed to save tube journeys: %v", err)
+			}
+			tubeKeys, tubes = nil, nil
+		}
+		return nil
+	}
+
+	for {
+		var record backupRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read backup: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		switch record.Kind {
+		case "HourlyUsage":
+			var usage models.HourlyUsage
+			if err = json.Unmarshal(record.Entity, &usage); err == nil {
+				_, err = storeSpans(c, usage.At, common.HourlySpans(usage))
+			}
+		case "Piece":
+			var piece models.Piece
+			if err = json.Unmarshal(record.Entity, &piece); err == nil {
+				pieceKeys = append(pieceKeys, datastore.NewKey(c, "Piece", "", piece.Start.Unix(), nil))
+				pieces = append(pieces, &piece)
+			}
+		case "Tube":
+			var tube models.Tube
+			if err = json.Unmarshal(record.Entity, &tube); err == nil {
+				tubeKeys = append(tubeKeys, datastore.NewKey(c, "Tube", "", tube.Start.Unix(), nil))
+				tubes = append(tubes, &tube)
+			}
+		case "Meeting":
+			var meeting models.Meeting
+			if err = json.Unmarshal(record.Entity, &meeting); err == nil {
+				_, err = datastore.Put(c, meetingKey(c, meeting), &meeting)
+			}
+		case "Annotation":
+			var annotation models.Annotation
+			if err = json.Unmarshal(record.Entity, &annotation); err == nil {
+				id := record.ID
+				if id == 0 {
+					// Before version 4, annotations were keyed by when they were created.
+					id = annotation.Created.UnixNano() / 1e6
+				}
+				_, err = datastore.Put(c, datastore.NewKey(c, "Annotation", "", id, nil), &annotation)
+			}
+		case "RuleSet":
+			var ruleSet models.RuleSet
+			if err = json.Unmarshal(record.Entity, &ruleSet); err == nil {
+				_, err = datastore.Put(c, datastore.NewKey(c, "RuleSet", "", ruleSet.Version, nil), &ruleSet)
+			}
+		case "RepoIndex":
+			var index models.RepoIndex
+			if err = json.Unmarshal(record.Entity, &index); err == nil {
+				_, err = datastore.Put(c, datastore.NewKey(c, "RepoIndex", index.Hostname, 0, nil), &index)
+			}
+		case "Commit":
+			var commit models.Commit
+			if err = json.Unmarshal(record.Entity, &commit); err == nil {
+				_, err = datastore.Put(c, commitKey(c, commit), &commit)
+			}
+		case "HostClock":
+			var clock models.HostClock
+			if err = json.Unmarshal(record.Entity, &clock); err == nil {
+				_, err = datastore.Put(c, datastore.NewKey(c, "HostClock", clock.Hostname, 0, nil), &clock)
+			}
+		case "SilentDevice":
+			var silent models.SilentDevice
+			if err = json.Unmarshal(record.Entity, &silent); err == nil {
+				_, err = datastore.Put(c, datastore.NewKey(c, "SilentDevice", silent.Device, 0, nil), &silent)
+			}
+		case "BudgetAlert":
+			var alert models.BudgetAlert
+			if err = json.Unmarshal(record.Entity, &alert); err == nil {
+				_, err = datastore.Put(c, budgetAlertKey(c, alert.Budget, alert.Day), &alert)
+			}
+		case "SentDigest":
+			var sent models.SentDigest
+			if err = json.Unmarshal(record.Entity, &sent); err == nil {
+				_, err = datastore.Put(c, sentDigestKey(c, sent.Period, sent.From, sent.Recipient), &sent)
+			}
+		default:
+			err = fmt.Errorf("Unknown kind %q", record.Kind)
+		}
+		if err == nil {
+			err = flush(false)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to restore %s: %v", record.Kind, err), http.StatusInternalServerError)
+			return
+		}
+		counts[record.Kind]++
+	}
+	if err := flush(true); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
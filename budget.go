@@ -0,0 +1,361 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/taskqueue"
+
+	"models"
+	"usage"
+)
+
+// Budget limits the time spent per day in categories of the usage tree, e.g. ["chrome", "reddit"].
+type Budget struct {
+	Name       string
+	Categories [][]string
+	// Max is the most time that should be spent in the categories, zero for no maximum.
+	Max time.Duration
+	// Min is the least time that should be spent in the categories, zero for no minimum.
+	Min time.Duration
+}
+
+var budgets = []Budget{
+	{Name: "news", Categories: [][]string{{"chrome", "news.ycombinator"}}, Max: 45 * time.Minute},
+	{Name: "reddit", Categories: [][]string{{"chrome", "reddit"}}, Max: 30 * time.Minute},
+	{Name: "coding", Categories: [][]string{{"sublime-text"}, {"vscode"}, {"intellij-idea"}, {"goland"},
+		{"pycharm"}, {"clion"}, {"vim"}, {"terminal"}}, Min: 4 * time.Hour},
+}
+
+// budgetCheckInterval is how long usage of a day is collected before its budgets are checked.
+const budgetCheckInterval = time.Minute
+
+func init() {
+	http.HandleFunc("/budgets/", budgetsHandler)
+	http.HandleFunc("/cron/budgets/", budgetsCronHandler)
+	http.HandleFunc("/tasks/budgets/", budgetsTaskHandler)
+}
+
+// BudgetStatus is how much time was spent in the category of a budget on a day.
+type BudgetStatus struct {
+	Name     string        `json:"name"`
+	Category string        `json:"category"`
+	Spent    time.Duration `json:"-"`
+	Seconds  int64         `json:"spent_seconds"`
+	Max      int64         `json:"max_seconds,omitempty"`
+	Min      int64         `json:"min_seconds,omitempty"`
+	Exceeded bool          `json:"exceeded"`
+	Met      bool          `json:"met"` // Whether the minimum was reached
+	// RulesVersion is the version of the rules the time was categorized with, 0 for the built-in
+	// rules.
+	RulesVersion int64 `json:"rules_version"`
+}
+
+// budgetsHandler returns the status of all budgets on the requested day as JSON.
+func budgetsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	day := BeginningOfDay(time.Now().In(loc))
+	if r.FormValue("date") != "" {
+		if day, err = time.ParseInLocation("2006-01-02", r.FormValue("date"), loc); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse date: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	spent, rulesVersion, err := budgetSpent(c, day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var statuses []BudgetStatus
+	for _, budget := range budgets {
+		statuses = append(statuses, budgetStatus(budget, spent[budget.Name], rulesVersion))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		c.Errorf("Failed to write budgets: %v", err)
+	}
+}
+
+// budgetsCronHandler runs at the end of each day and notifies about the budgets whose minimum
+// wasn't reached on the previous day.
+func budgetsCronHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	day := BeginningOfDay(time.Now().In(loc)).AddDate(0, 0, -1)
+	if err := checkBudgets(c, day, true); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("%v", err)
+		return
+	}
+}
+
+// queueBudgetChecks queues checking the maxima of the budgets of the days of the hours usage was
+// logged for, see budgetsTaskHandler. Tasks are named after the day and the current
+// budgetCheckInterval, so however much is logged, each day is checked at most once per interval.
+func queueBudgetChecks(c appengine.Context, hours []time.Time) error {
+	hasMax := false
+	for _, budget := range budgets {
+		hasMax = hasMax || budget.Max != 0
+	}
+	if !hasMax || len(hours) == 0 {
+		return nil
+	}
+	loc, err := location()
+	if err != nil {
+		return fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	dates := make(map[string]bool)
+	for _, hour := range hours {
+		dates[hour.In(loc).Format("2006-01-02")] = true
+	}
+
+	now := time.Now()
+	bucket := now.Truncate(budgetCheckInterval)
+	for date := range dates {
+		task := taskqueue.NewPOSTTask("/tasks/budgets/", url.Values{"date": {date}})
+		task.Name = fmt.Sprintf("budget-%s-%d", date, bucket.Unix()/int64(budgetCheckInterval/time.Second))
+		// Run once the interval is over, to include everything logged during it.
+		task.Delay = bucket.Add(budgetCheckInterval).Sub(now)
+		if _, err := taskqueue.Add(c, task, ""); err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+			return fmt.Errorf("Failed to queue budget check for %s: %v", date, err)
+		}
+	}
+	return nil
+}
+
+// budgetsTaskHandler notifies about all budgets whose maximum was exceeded on the given date.
+func budgetsTaskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	day, err := time.ParseInLocation("2006-01-02", r.FormValue("date"), loc)
+	if err != nil {
+		// Retrying won't help.
+		c.Errorf("Failed to parse date: %v", err)
+		return
+	}
+	if err := checkBudgets(c, day, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("%v", err)
+		return
+	}
+}
+
+func budgetCategories(budget Budget) string {
+	var categories []string
+	for _, category := range budget.Categories {
+		categories = append(categories, strings.Join(category, "/"))
+	}
+	return strings.Join(categories, ", ")
+}
+
+func budgetStatus(budget Budget, spent time.Duration, rulesVersion int64) BudgetStatus {
+	return BudgetStatus{
+		Name:         budget.Name,
+		Category:     budgetCategories(budget),
+		Spent:        spent,
+		Seconds:      int64(spent.Seconds()),
+		Max:          int64(budget.Max.Seconds()),
+		Min:          int64(budget.Min.Seconds()),
+		Exceeded:     budget.Max != 0 && spent > budget.Max,
+		Met:          spent >= budget.Min,
+		RulesVersion: rulesVersion,
+	}
+}
+
+// checkBudgets notifies about all budgets whose maximum was exceeded on day, or, once the day is
+// over, about the ones whose minimum wasn't reached. Each budget is only notified about once a day.
+func checkBudgets(c appengine.Context, day time.Time, dayOver bool) error {
+	var relevant []Budget
+	for _, budget := range budgets {
+		if (!dayOver && budget.Max != 0) || (dayOver && budget.Min != 0) {
+			relevant = append(relevant, budget)
+		}
+	}
+	if len(relevant) == 0 {
+		return nil
+	}
+
+	spent, rulesVersion, err := budgetSpent(c, day)
+	if err != nil {
+		return err
+	}
+	for _, budget := range relevant {
+		status := budgetStatus(budget, spent[budget.Name], rulesVersion)
+		if (!dayOver && status.Exceeded) || (dayOver && !status.Met) {
+			if err := notifyBudget(c, budget, day, status); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// budgetSpent returns the time spent in the category of each budget on day, counted like on the
+// graph page, and the version of the rules it was categorized with.
+func budgetSpent(c appengine.Context, day time.Time) (map[string]time.Duration, int64, error) {
+	usages, err := queryUsage(c, day, day.Add(time.Hour*24))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to query usage logs: %v", err)
+	}
+	pieces, err := queryPieces(c, day, day.Add(time.Hour*24))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to query midi logs: %v", err)
+	}
+	meetings, err := queryMeetings(c, day, day.Add(time.Hour*24))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to query meetings: %v", err)
+	}
+	annotations, _, err := queryAnnotations(c, day, day.Add(time.Hour*24))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to query annotations: %v", err)
+	}
+	rules, err := loadRules(c, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	categories, err := usage.MakeLogger(rules.Rules, usage.DefaultEditorDepth)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to create logger: %v", err)
+	}
+
+	logger := &budgetLogger{Logger: categories, spent: make(map[string]time.Duration)}
+	spansByDevice, _ := filterIdles(usages)
+	addDayUsage(logger, day, spansByDevice, devicePriority("", spansByDevice), meetings, annotations)
+	for _, piece := range pieces {
+		logger.AddSpan(pieceSpan(piece))
+	}
+	return logger.spent, rules.Version, nil
+}
+
+// budgetLogger sums up the time spent in the category of each budget.
+type budgetLogger struct {
+	usage.Logger
+	spent map[string]time.Duration
+}
+
+func (l *budgetLogger) AddSpan(span models.Span) {
+	category := l.Category(span)
+	for _, budget := range budgets {
+		for _, budgetCategory := range budget.Categories {
+			if usage.HasPrefix(category, budgetCategory) {
+				l.spent[budget.Name] += span.End.Sub(span.Start)
+				break
+			}
+		}
+	}
+}
+
+func budgetAlertKey(c appengine.Context, budget string, day time.Time) *datastore.Key {
+	return datastore.NewKey(c, "BudgetAlert", fmt.Sprintf("%s/%s", budget, day.Format("2006-01-02")), 0, nil)
+}
+
+// notifyBudget mails the admins and fires a webhook event about status unless that was already done
+// for the budget on day. If the mail was sent but the event couldn't be queued, only the event is
+// retried with the next check.
+func notifyBudget(c appengine.Context, budget Budget, day time.Time, status BudgetStatus) error {
+	key := budgetAlertKey(c, budget.Name, day)
+	alert := models.BudgetAlert{
+		Budget:       budget.Name,
+		Day:          day,
+		Spent:        status.Spent,
+		RulesVersion: status.RulesVersion,
+	}
+	claimed := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var existing models.BudgetAlert
+		err := datastore.Get(c, key, &existing)
+		if err == nil {
+			// Unless only the event is left, another check is already notifying.
+			if existing.Mailed && !existing.Fired {
+				alert, claimed = existing, true
+			}
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		claimed = true
+		_, err = datastore.Put(c, key, &alert)
+		return err
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to save alert for budget %s: %v", budget.Name, err)
+	}
+	if !claimed {
+		return nil
+	}
+
+	if !alert.Mailed {
+		if err := mailBudgetNotification(c, budget, day, status); err != nil {
+			// Try again with the next check.
+			if err := datastore.Delete(c, key); err != nil {
+				c.Errorf("Failed to delete alert for budget %s: %v", budget.Name, err)
+			}
+			return err
+		}
+		alert.Mailed = true
+		alert.Sent = time.Now()
+		if _, err := datastore.Put(c, key, &alert); err != nil {
+			return fmt.Errorf("Failed to save alert for budget %s: %v", budget.Name, err)
+		}
+	}
+
+	err = fireEvent(c, eventBudgetBreached, map[string]interface{}{
+		"date":   day.Format("2006-01-02"),
+		"budget": status,
+	})
+	if err != nil {
+		return err
+	}
+	alert.Fired = true
+	if _, err := datastore.Put(c, key, &alert); err != nil {
+		return fmt.Errorf("Failed to save alert for budget %s: %v", budget.Name, err)
+	}
+	return nil
+}
+
+func mailBudgetNotification(c appengine.Context, budget Budget, day time.Time, status BudgetStatus) error {
+	var subject string
+	if status.Exceeded {
+		subject = fmt.Sprintf("Budget %s exceeded: %s of at most %s on %s", budget.Name,
+			status.Spent, budget.Max, day.Format("2006-01-02"))
+	} else {
+		subject = fmt.Sprintf("Budget %s not met: %s of at least %s on %s", budget.Name,
+			status.Spent, budget.Min, day.Format("2006-01-02"))
+	}
+
+	msg := &mail.Message{
+		Sender:  fmt.Sprintf("App Usage <notifications@%s.appspotmail.com>", appengine.AppID(c)),
+		Subject: subject,
+		Body: fmt.Sprintf("%s\n\nCategory: %s\nCategorized with %s\n", subject, status.Category,
+			rulesVersionName(status.RulesVersion)),
+	}
+	if err := mail.SendToAdmins(c, msg); err != nil {
+		return fmt.Errorf("Failed to mail notification for budget %s: %v", budget.Name, err)
+	}
+	return nil
+}
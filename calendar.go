@@ -0,0 +1,221 @@
+package usage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+
+	"importer"
+	"models"
+	"usage"
+)
+
+// calendarURLs are the iCalendar feeds that are imported every hour.
+var calendarURLs = []string{}
+
+// calendarHorizon is how far into the future recurring meetings are expanded.
+const calendarHorizon = 90 * 24 * time.Hour
+
+// calendarHistory is how far into the past meetings are imported. Importing a calendar again only
+// replaces its meetings within calendarHistory and calendarHorizon, older ones are kept.
+const calendarHistory = 365 * 24 * time.Hour
+
+// meetingBatchSize is the number of meetings that are saved or deleted at once.
+const meetingBatchSize = 100
+
+func init() {
+	http.HandleFunc("/cron/calendars/", calendarsCronHandler)
+}
+
+// calendarsCronHandler imports all calendarURLs.
+func calendarsCronHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	for _, url := range calendarURLs {
+		if _, err := importCalendarURL(c, url, ""); err != nil {
+			c.Errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// importCalendarURL imports the iCalendar file at url and returns how many meetings it contained.
+func importCalendarURL(c appengine.Context, url, calendar string) (int, error) {
+	res, err := urlfetch.Client(c).Get(url)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to fetch calendar %s: %v", url, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Fetching calendar %s failed with status %d", url, res.StatusCode)
+	}
+	return importCalendar(c, res.Body, calendar)
+}
+
+// importCalendar saves the meetings of an iCalendar file, overriding the name of its calendar if
+// calendar isn't empty. Meetings are keyed by their UID and start, so importing the same calendar
+// again updates them. Stored meetings of the calendar that are no longer in the file, because they
+// were moved or cancelled, are deleted.
+func importCalendar(c appengine.Context, r io.Reader, calendar string) (int, error) {
+	loc, err := location()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	since := time.Now().Add(-calendarHistory)
+	until := time.Now().Add(calendarHorizon)
+	meetings, err := importer.ICS(r, loc, since, until)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse calendar: %v", err)
+	}
+	if calendar == "" && len(meetings) > 0 {
+		calendar = meetings[0].Calendar
+	}
+
+	for start := 0; start < len(meetings); start += meetingBatchSize {
+		end := start + meetingBatchSize
+		if end > len(meetings) {
+			end = len(meetings)
+		}
+		var keys []*datastore.Key
+		var batch []*models.Meeting
+		for i := range meetings[start:end] {
+			meeting := &meetings[start+i]
+			if calendar != "" {
+				meeting.Calendar = calendar
+			}
+			keys = append(keys, meetingKey(c, *meeting))
+			batch = append(batch, meeting)
+		}
+		if _, err := datastore.PutMulti(c, keys, batch); err != nil {
+			return 0, fmt.Errorf("Failed to save meetings: %v", err)
+		}
+	}
+
+	if calendar == "" {
+		c.Warningf("Not deleting stale meetings of a calendar without a name")
+		return len(meetings), nil
+	}
+	if err := deleteStaleMeetings(c, calendar, since, until, meetings); err != nil {
+		return 0, err
+	}
+	return len(meetings), nil
+}
+
+// deleteStaleMeetings deletes the stored meetings of calendar starting in [from, to) that aren't
+// in current.
+func deleteStaleMeetings(c appengine.Context, calendar string, from, to time.Time, current []models.Meeting) error {
+	keep := make(map[string]bool)
+	for _, meeting := range current {
+		keep[meetingKey(c, meeting).StringID()] = true
+	}
+	q := datastore.NewQuery("Meeting").
+		Filter("Start >=", from).
+		Filter("Start <", to)
+	var stored []models.Meeting
+	keys, err := q.GetAll(c, &stored)
+	if err != nil {
+		return fmt.Errorf("Failed to query meetings: %v", err)
+	}
+	var stale []*datastore.Key
+	for i, meeting := range stored {
+		if meeting.Calendar == calendar && !keep[keys[i].StringID()] {
+			stale = append(stale, keys[i])
+		}
+	}
+	for start := 0; start < len(stale); start += meetingBatchSize {
+		end := start + meetingBatchSize
+		if end > len(stale) {
+			end = len(stale)
+		}
+		if err := datastore.DeleteMulti(c, stale[start:end]); err != nil {
+			return fmt.Errorf("Failed to delete stale meetings: %v", err)
+		}
+	}
+	if len(stale) > 0 {
+		c.Infof("Deleted %d meetings no longer in calendar %s", len(stale), calendar)
+	}
+	return nil
+}
+
+func meetingKey(c appengine.Context, meeting models.Meeting) *datastore.Key {
+	uid := meeting.UID
+	if uid == "" {
+		uid = meeting.Summary
+	}
+	return datastore.NewKey(c, "Meeting", fmt.Sprintf("%s/%d", uid, meeting.Start.Unix()), 0, nil)
+}
+
+// queryMeetings returns all meetings overlapping [from, to). Meetings are assumed to be shorter than
+// a day.
+func queryMeetings(c appengine.Context, from, to time.Time) ([]models.Meeting, error) {
+	q := datastore.NewQuery("Meeting").
+		Filter("Start >=", from.Add(-24*time.Hour)).
+		Filter("Start <", to).
+		Order("Start")
+	var meetings []models.Meeting
+	if _, err := q.GetAll(c, &meetings); err != nil {
+		return nil, err
+	}
+	var overlapping []models.Meeting
+	for _, meeting := range meetings {
+		if meeting.End.After(from) {
+			overlapping = append(overlapping, meeting)
+		}
+	}
+	return overlapping, nil
+}
+
+// meetingLogger attributes the parts of spans during meetings to a "meetings" node of the tree with
+// one child per meeting, and passes everything else on unchanged.
+type meetingLogger struct {
+	usage.Logger
+	meetings []models.Meeting
+}
+
+func (l *meetingLogger) AddSpan(span models.Span) {
+	// Time during overlapping meetings goes to the one that started first.
+	var claimed []period
+	for _, meeting := range l.meetings {
+		start, end := meeting.Start, meeting.End
+		if start.Before(span.Start) {
+			start = span.Start
+		}
+		if end.After(span.End) {
+			end = span.End
+		}
+		if !end.After(start) {
+			continue
+		}
+		parts := subtract(period{start, end}, claimed)
+		for _, p := range parts {
+			part := span
+			part.Start, part.End = p.Start, p.End
+			part.Focused = models.App{Process: "meetings", WindowTitle: meeting.Summary}
+			l.Logger.AddSpan(part)
+		}
+		claimed = mergePeriods(append(claimed, parts...))
+	}
+	for _, p := range subtract(period{span.Start, span.End}, claimed) {
+		span.Start, span.End = p.Start, p.End
+		l.Logger.AddSpan(span)
+	}
+}
+
+// meetingIntervals returns the timeline track of meetings.
+func meetingIntervals(meetings []models.Meeting) map[string]interface{} {
+	var intervals []map[string]int64
+	for _, meeting := range meetings {
+		intervals = append(intervals, map[string]int64{
+			"starting_time": meeting.Start.Unix() * 1000,
+			"ending_time":   meeting.End.Unix() * 1000,
+		})
+	}
+	return map[string]interface{}{
+		"label": "meetings",
+		"times": intervals,
+	}
+}
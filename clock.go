@@ -0,0 +1,157 @@
+package usage
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"models"
+)
+
+// clientTimeHeader is the header in which clients send their current time to /log/, as a Unix
+// timestamp in seconds.
+const clientTimeHeader = "X-Client-Time"
+
+// largeClockSkew is the skew beyond which hosts are flagged in the admin view.
+const largeClockSkew = time.Minute
+
+// minCorrectedSkew is the skew below which logs aren't corrected even if correction is enabled,
+// since it's within what network latency adds to the measurement.
+const minCorrectedSkew = 5 * time.Second
+
+var clocksTemplate = template.Must(template.ParseFiles("templates/clocks.html"))
+
+func init() {
+	http.HandleFunc("/admin/clocks/", clocksHandler)
+}
+
+// clientSkew returns the clock skew of the client that sent r, if the request says what time the
+// client thinks it is.
+func clientSkew(r *http.Request, receivedAt time.Time) (time.Duration, bool, error) {
+	header := r.Header.Get(clientTimeHeader)
+	if header == "" {
+		return 0, false, nil
+	}
+	clientTime, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to parse %s: %v", clientTimeHeader, err)
+	}
+	return receivedAt.Sub(time.Unix(0, int64(clientTime*1e9))), true, nil
+}
+
+// updateClocks records the clock skew of the given hosts if it was measured, and returns the known
+// clocks of the hosts. Clocks are updated in transactions so that the admin turning correction on
+// or off at the same time isn't overwritten.
+func updateClocks(c appengine.Context, hostnames []string, receivedAt time.Time, skew time.Duration, measured bool) (map[string]models.HostClock, error) {
+	clocks := make(map[string]models.HostClock)
+	for _, hostname := range hostnames {
+		key := datastore.NewKey(c, "HostClock", hostname, 0, nil)
+		var clock models.HostClock
+		if !measured {
+			err := datastore.Get(c, key, &clock)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, fmt.Errorf("Failed to get clock of %s: %v", hostname, err)
+			}
+			clock.Hostname = hostname
+			clocks[hostname] = clock
+			continue
+		}
+
+		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			clock = models.HostClock{}
+			err := datastore.Get(c, key, &clock)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			clock.Hostname = hostname
+			clock.Skew = skew
+			clock.Measured = receivedAt
+			_, err = datastore.Put(c, key, &clock)
+			return err
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save clock of %s: %v", hostname, err)
+		}
+		clocks[hostname] = clock
+	}
+	return clocks, nil
+}
+
+// correctTime returns t as it would have been on the server, if correction is enabled for the host.
+func correctTime(clock models.HostClock, t time.Time) time.Time {
+	if !clock.Correct || (clock.Skew < minCorrectedSkew && clock.Skew > -minCorrectedSkew) {
+		return t
+	}
+	return t.Add(clock.Skew)
+}
+
+// clocksHandler shows the clock skew of all hosts and lets the admin turn correction on and off.
+func clocksHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method == "POST" {
+		hostname := r.FormValue("host")
+		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			key := datastore.NewKey(c, "HostClock", hostname, 0, nil)
+			var clock models.HostClock
+			if err := datastore.Get(c, key, &clock); err != nil {
+				return err
+			}
+			clock.Correct = r.FormValue("correct") == "true"
+			_, err := datastore.Put(c, key, &clock)
+			return err
+		}, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to update clock of %s: %v", hostname, err), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/admin/clocks/", http.StatusSeeOther)
+		return
+	}
+
+	var clocks []models.HostClock
+	if _, err := datastore.NewQuery("HostClock").GetAll(c, &clocks); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query clocks: %v", err), http.StatusInternalServerError)
+		return
+	}
+	sort.Sort(bySkew(clocks))
+
+	type row struct {
+		models.HostClock
+		Large bool
+	}
+	var rows []row
+	for _, clock := range clocks {
+		rows = append(rows, row{clock, clock.Skew > largeClockSkew || clock.Skew < -largeClockSkew})
+	}
+
+	data := make(map[string]interface{})
+	data["Clocks"] = rows
+	data["LargeClockSkew"] = largeClockSkew
+	if err := clocksTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// bySkew sorts clocks by how far off they are, worst first.
+type bySkew []models.HostClock
+
+func (a bySkew) Len() int      { return len(a) }
+func (a bySkew) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySkew) Less(i, j int) bool {
+	return absDuration(a[i].Skew) > absDuration(a[j].Skew)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
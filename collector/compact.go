@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"math"
+)
+
+// spansContentType is the content type of the compact upload format understood by /log/.
+const spansContentType = "application/vnd.app-usage.spans+json"
+
+type Spans struct {
+	Hostname string
+	Spans    []Span
+}
+
+// Span stands for Count consecutive samples with the same focused window, taken Interval apart.
+// The server reconstructs the last activity of earlier samples from the one of the last sample.
+type Span struct {
+	Time         float64
+	Count        int
+	Focused      App
+	LastActivity float64 `json:"last_activity_ms"`
+	Interval     float64 `json:"interval_ms"`
+}
+
+// compact collapses consecutive samples of the same window into spans. Samples are only joined if
+// the server can reconstruct them: the user must either have been active throughout, or have been
+// idle throughout with the time since the last activity growing by the interval. Samples without a
+// focused window are dropped, the server doesn't log them anyway.
+func compact(samples []Sample) []Spans {
+	var batches []Spans
+	var last *Span
+	for _, sample := range samples {
+		if len(sample.Focused) == 0 {
+			continue
+		}
+		if len(batches) == 0 || batches[len(batches)-1].Hostname != sample.Hostname {
+			batches = append(batches, Spans{Hostname: sample.Hostname})
+			last = nil
+		}
+		batch := &batches[len(batches)-1]
+
+		if last != nil && last.Focused == sample.Focused[0] && last.Interval == sample.Interval &&
+			continues(*last, sample) {
+			last.Count++
+			last.LastActivity = sample.LastActivity
+			continue
+		}
+		batch.Spans = append(batch.Spans, Span{
+			Time:         sample.Time,
+			Count:        1,
+			Focused:      sample.Focused[0],
+			LastActivity: sample.LastActivity,
+			Interval:     sample.Interval,
+		})
+		last = &batch.Spans[len(batch.Spans)-1]
+	}
+	return batches
+}
+
+// continues returns whether sample can be added to the end of span.
+func continues(span Span, sample Sample) bool {
+	// Allow for some jitter in when samples are taken.
+	tolerance := span.Interval / 10
+	expectedTime := span.Time + float64(span.Count)*span.Interval/1000
+	if math.Abs(sample.Time-expectedTime) > tolerance/1000 {
+		return false
+	}
+	if span.LastActivity < span.Interval && sample.LastActivity < span.Interval {
+		return true
+	}
+	return math.Abs(sample.LastActivity-(span.LastActivity+span.Interval)) <= tolerance
+}
+
+// encodeSpans returns the gzipped compact encoding of spans.
+func encodeSpans(spans Spans) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(spans); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
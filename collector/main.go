@@ -0,0 +1,122 @@
+// Command collector samples the focused window on a Linux desktop and uploads the samples to the
+// /log/ endpoint of the server. Samples are queued on disk first, so nothing is lost while offline.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	server         = flag.String("server", "https://app-usage.appspot.com", "URL of the server to upload to")
+	interval       = flag.Duration("interval", 10*time.Second, "How often to sample the focused window")
+	batchSize      = flag.Int("batch", 30, "Number of samples to upload at once")
+	compactUploads = flag.Bool("compact", true, "Upload gzipped spans instead of individual samples")
+	queueDir       = flag.String("queue", filepath.Join(os.Getenv("HOME"), ".cache", "app-usage"), "Directory for samples waiting to be uploaded")
+	repoDirs       = flag.String("repos", "", "Comma-separated directories to search for git repositories, so that coding time can be attributed to them")
+	repoInterval   = flag.Duration("repos_interval", time.Hour, "How often to search for and upload git repositories")
+	idleHintDelay  = flag.Duration("idle_hint_delay", 0, "Timeout of the idle daemon (e.g. swayidle) after which logind marks Wayland sessions as idle")
+)
+
+func main() {
+	flag.Parse()
+
+	windows, idle, err := DetectSources(*idleHintDelay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sampler, err := NewSampler(windows, idle, *interval)
+	if err != nil {
+		log.Fatalf("Failed to create sampler: %v", err)
+	}
+	queue, err := NewQueue(*queueDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploader := &Uploader{
+		URL:     *server + "/log/",
+		Queue:   queue,
+		Client:  &http.Client{Timeout: time.Minute},
+		Compact: *compactUploads,
+	}
+
+	wake := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		uploader.Run(wake, stop)
+		close(done)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	var batch []Sample
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := queue.Push(batch); err != nil {
+			log.Printf("Failed to queue samples: %v", err)
+			return
+		}
+		batch = nil
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	uploadRepos := func() {
+		if *repoDirs == "" {
+			return
+		}
+		repos, err := FindRepos(strings.Split(*repoDirs, ","))
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Printf("Failed to get hostname: %v", err)
+			return
+		}
+		if err := UploadRepos(uploader.Client, *server+"/repos/index/", hostname, repos); err != nil {
+			log.Printf("Failed to upload repositories: %v", err)
+		}
+	}
+	go uploadRepos()
+	repoTicker := time.NewTicker(*repoInterval)
+	defer repoTicker.Stop()
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-repoTicker.C:
+			go uploadRepos()
+		case now := <-ticker.C:
+			sample, err := sampler.Sample(now)
+			if err != nil {
+				log.Printf("Failed to sample: %v", err)
+				continue
+			}
+			batch = append(batch, sample)
+			if len(batch) >= *batchSize {
+				flush()
+			}
+		case <-signals:
+			flush()
+			close(stop)
+			<-done
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Queue is a directory of batches of samples waiting to be uploaded, one JSON file per batch. It
+// survives restarts and holds on to samples for as long as the server can't be reached.
+type Queue struct {
+	dir string
+}
+
+func NewQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create queue directory: %v", err)
+	}
+	return &Queue{dir: dir}, nil
+}
+
+// Push adds a batch to the end of the queue.
+func (q *Queue) Push(samples []Sample) error {
+	return writeBatch(q.dir, fmt.Sprintf("%020d.json", time.Now().UnixNano()), samples)
+}
+
+// Replace replaces the samples of a queued batch, e.g. with the ones that are left to upload.
+func (q *Queue) Replace(name string, samples []Sample) error {
+	return writeBatch(q.dir, name, samples)
+}
+
+func writeBatch(dir, name string, samples []Sample) error {
+	data, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash never leaves a partial batch in the queue.
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// Batches returns the names of all queued batches, oldest first.
+func (q *Queue) Batches() ([]string, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Read returns the content of a queued batch.
+func (q *Queue) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(q.dir, name))
+}
+
+// Remove deletes a batch once it was uploaded.
+func (q *Queue) Remove(name string) error {
+	return os.Remove(filepath.Join(q.dir, name))
+}
+
+// Quarantine moves a batch the server rejected out of the queue into the rejected subdirectory, so
+// that it doesn't hold up later batches but can still be looked at.
+func (q *Queue) Quarantine(name string) error {
+	dir := filepath.Join(q.dir, "rejected")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Failed to create rejected directory: %v", err)
+	}
+	return os.Rename(filepath.Join(q.dir, name), filepath.Join(dir, name))
+}
+
+// QuarantineSamples saves part of a batch the server rejected in the rejected subdirectory, under
+// the given name.
+func (q *Queue) QuarantineSamples(name string, samples []Sample) error {
+	dir := filepath.Join(q.dir, "rejected")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Failed to create rejected directory: %v", err)
+	}
+	return writeBatch(dir, name, samples)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxRepoDepth is how deep below the searched directories repositories are looked for.
+const maxRepoDepth = 3
+
+// FindRepos returns the working trees of the git repositories in and below dirs, with the home
+// directory replaced by "~" like in window titles.
+func FindRepos(dirs []string) ([]string, error) {
+	home := os.Getenv("HOME")
+	var repos []string
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Skip directories that can't be read.
+				if info != nil && info.IsDir() && path != dir {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if strings.Count(path[len(dir):], string(filepath.Separator)) > maxRepoDepth {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+				if home != "" && (path == home || strings.HasPrefix(path, home+"/")) {
+					repos = append(repos, "~"+path[len(home):])
+				} else {
+					repos = append(repos, path)
+				}
+				return filepath.SkipDir
+			}
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to search %s for repositories: %v", dir, err)
+		}
+	}
+	return repos, nil
+}
+
+// UploadRepos sends the repositories of hostname to the /repos/index/ endpoint at url.
+func UploadRepos(client *http.Client, url, hostname string, repos []string) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"hostname": hostname,
+		"paths":    repos,
+	})
+	if err != nil {
+		return err
+	}
+	res, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Server responded with status %d: %s", res.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Sample is one observation of what the user was doing, in the format /log/ expects.
+type Sample struct {
+	Time         float64 // Unix timestamp in seconds
+	Focused      []App
+	Visible      []App
+	LastActivity float64 `json:"last_activity_ms"`
+	Hostname     string
+	Interval     float64 `json:"interval_ms"`
+}
+
+type App struct {
+	Name string // Window title
+	Exec string // Name of the process owning the window
+}
+
+// Sampler takes samples from a window and an idle source.
+type Sampler struct {
+	Windows  WindowSource
+	Idle     IdleSource
+	Interval time.Duration
+	Hostname string
+}
+
+func NewSampler(windows WindowSource, idle IdleSource, interval time.Duration) (*Sampler, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &Sampler{
+		Windows:  windows,
+		Idle:     idle,
+		Interval: interval,
+		Hostname: hostname,
+	}, nil
+}
+
+// Sample returns what the user is doing right now. A sample without a focused window is still
+// valid, e.g. while the screen is locked.
+func (s *Sampler) Sample(now time.Time) (Sample, error) {
+	sample := Sample{
+		Time:     float64(now.UnixNano()) / 1e9,
+		Hostname: s.Hostname,
+		Interval: float64(s.Interval / time.Millisecond),
+	}
+
+	focused, err := s.Windows.Focused()
+	if err != nil {
+		return sample, err
+	}
+	if focused != nil {
+		sample.Focused = []App{*focused}
+	}
+	sample.Visible, err = s.Windows.Visible()
+	if err != nil {
+		return sample, err
+	}
+
+	idle, err := s.Idle.Idle()
+	if err != nil {
+		return sample, err
+	}
+	sample.LastActivity = float64(idle / time.Millisecond)
+	return sample, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeWindows is a WindowSource with fixed windows.
+type fakeWindows struct {
+	focused *App
+	visible []App
+	err     error
+}
+
+func (f fakeWindows) Focused() (*App, error)  { return f.focused, f.err }
+func (f fakeWindows) Visible() ([]App, error) { return f.visible, f.err }
+
+type fakeIdle time.Duration
+
+func (f fakeIdle) Idle() (time.Duration, error) { return time.Duration(f), nil }
+
+func TestSample(t *testing.T) {
+	editor := App{Name: "main.go - Sublime Text", Exec: "sublime_text"}
+	browser := App{Name: "GitHub - Chrome", Exec: "chrome"}
+	sampler := &Sampler{
+		Windows:  fakeWindows{focused: &editor, visible: []App{editor, browser}},
+		Idle:     fakeIdle(1500 * time.Millisecond),
+		Interval: 10 * time.Second,
+		Hostname: "laptop",
+	}
+
+	sample, err := sampler.Sample(time.Unix(1500000000, 500000000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Sample{
+		Time:         1500000000.5,
+		Focused:      []App{editor},
+		Visible:      []App{editor, browser},
+		LastActivity: 1500,
+		Hostname:     "laptop",
+		Interval:     10000,
+	}
+	if !reflect.DeepEqual(sample, want) {
+		t.Errorf("Sample() = %+v, want %+v", sample, want)
+	}
+}
+
+func TestSampleWithoutFocus(t *testing.T) {
+	sampler := &Sampler{Windows: fakeWindows{}, Idle: fakeIdle(0)}
+	sample, err := sampler.Sample(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sample.Focused != nil {
+		t.Errorf("Focused = %v, want none", sample.Focused)
+	}
+}
+
+func TestSampleError(t *testing.T) {
+	sampler := &Sampler{Windows: fakeWindows{err: errors.New("xdotool missing")}, Idle: fakeIdle(0)}
+	if _, err := sampler.Sample(time.Now()); err == nil {
+		t.Error("Sample() succeeded although the window source failed")
+	}
+}
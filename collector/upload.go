@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minBackoff = 10 * time.Second
+	maxBackoff = 10 * time.Minute
+)
+
+// Uploader sends queued batches to the /log/ endpoint of the server, oldest first.
+type Uploader struct {
+	URL    string
+	Queue  *Queue
+	Client *http.Client
+	// Compact makes the uploader send gzipped spans instead of the plain list of samples.
+	Compact bool
+}
+
+// Run uploads batches until stop is closed, backing off exponentially while uploads fail. wake
+// signals that a new batch was queued.
+func (u *Uploader) Run(wake <-chan struct{}, stop <-chan struct{}) {
+	backoff := time.Duration(0)
+	for {
+		if err := u.uploadAll(); err != nil {
+			if backoff == 0 {
+				backoff = minBackoff
+			} else if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			log.Printf("Upload failed, retrying in %s: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		select {
+		case <-wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// rejectedError is returned for batches the server rejected as invalid, which won't succeed when
+// retried.
+type rejectedError struct {
+	status int
+	body   []byte
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("Server rejected batch with status %d: %s", e.status, e.body)
+}
+
+// uploadAll uploads all queued batches, stopping at the first one that fails. Batches the server
+// rejects are quarantined instead, so that they don't block the ones after them.
+func (u *Uploader) uploadAll() error {
+	names, err := u.Queue.Batches()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := u.Queue.Read(name)
+		if err != nil {
+			return err
+		}
+		if !u.Compact {
+			err = u.post(data, "application/json", "")
+			if rejected, ok := err.(*rejectedError); ok {
+				log.Printf("Quarantining %s: %v", name, rejected)
+				if err := u.Queue.Quarantine(name); err != nil {
+					return err
+				}
+				continue
+			}
+		} else {
+			err = u.uploadCompact(name, data)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to upload %s: %v", name, err)
+		}
+		if err := u.Queue.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadCompact uploads a queued batch as spans, one request per host. After each request the
+// batch is rewritten without the samples that were sent, so that retrying it doesn't send them
+// again, and samples the server rejects are quarantined on their own.
+func (u *Uploader) uploadCompact(name string, data []byte) error {
+	var samples []Sample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return fmt.Errorf("Failed to parse queued samples: %v", err)
+	}
+	runs := splitByHost(samples)
+	for i, run := range runs {
+		for _, spans := range compact(run) {
+			encoded, err := encodeSpans(spans)
+			if err != nil {
+				return err
+			}
+			err = u.post(encoded, spansContentType, "gzip")
+			if rejected, ok := err.(*rejectedError); ok {
+				log.Printf("Quarantining %d samples of %s: %v", len(run), name, rejected)
+				if err := u.Queue.QuarantineSamples(fmt.Sprintf("%s-%d.json", strings.TrimSuffix(name, ".json"), i), run); err != nil {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+		}
+		var rest []Sample
+		for _, run := range runs[i+1:] {
+			rest = append(rest, run...)
+		}
+		if err := u.Queue.Replace(name, rest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitByHost splits samples into runs of consecutive samples of the same host.
+func splitByHost(samples []Sample) [][]Sample {
+	var runs [][]Sample
+	for i, sample := range samples {
+		if i == 0 || sample.Hostname != samples[i-1].Hostname {
+			runs = append(runs, nil)
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], sample)
+	}
+	return runs
+}
+
+// permanentStatuses are the statuses for which retrying a batch won't help. Other client errors,
+// like 408 Request Timeout or 429 Too Many Requests, are retried with backoff.
+var permanentStatuses = map[int]bool{
+	http.StatusBadRequest:            true,
+	http.StatusRequestEntityTooLarge: true,
+	422:                              true, // Unprocessable Entity
+}
+
+func (u *Uploader) post(data []byte, contentType, contentEncoding string) error {
+	req, err := http.NewRequest("POST", u.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	// Lets the server measure how far off the clock of this host is.
+	req.Header.Set("X-Client-Time", strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 3, 64))
+	res, err := u.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if permanentStatuses[res.StatusCode] {
+		return &rejectedError{res.StatusCode, body}
+	}
+	// On partial failures the whole batch is retried, the server ignores the duplicates.
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Server responded with status %d: %s", res.StatusCode, body)
+	}
+
+	var response struct {
+		RejectedReasons map[string]int `json:"rejected_reasons"`
+	}
+	if err := json.Unmarshal(body, &response); err == nil && len(response.RejectedReasons) > 0 {
+		log.Printf("Server rejected samples: %v", response.RejectedReasons)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUploadQuarantinesRejectedBatches(t *testing.T) {
+	var uploads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploads++
+		if uploads == 1 {
+			http.Error(w, "Invalid samples", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := queue.Push([]Sample{{Hostname: "laptop"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uploader := &Uploader{URL: server.URL, Queue: queue, Client: server.Client()}
+	if err := uploader.uploadAll(); err != nil {
+		t.Fatalf("uploadAll() = %v, want the rejected batch to be skipped", err)
+	}
+	if uploads != 2 {
+		t.Errorf("Uploaded %d batches, want 2", uploads)
+	}
+	if names, _ := queue.Batches(); len(names) != 0 {
+		t.Errorf("Queue still has %v", names)
+	}
+	rejected, _ := filepath.Glob(filepath.Join(dir, "rejected", "*.json"))
+	if len(rejected) != 1 {
+		t.Errorf("Quarantined %v, want one batch", rejected)
+	}
+}
+
+func TestUploadKeepsBatchesOnServerErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Datastore unavailable", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Push([]Sample{{Hostname: "laptop"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := &Uploader{URL: server.URL, Queue: queue, Client: server.Client()}
+	if err := uploader.uploadAll(); err == nil {
+		t.Error("uploadAll() succeeded although the server failed")
+	}
+	if names, _ := queue.Batches(); len(names) != 1 {
+		t.Errorf("Queue has %v, want the batch to be kept for retrying", names)
+	}
+}
+
+func TestUploadRetriesTransientClientErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Push([]Sample{{Hostname: "laptop"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := &Uploader{URL: server.URL, Queue: queue, Client: server.Client()}
+	if err := uploader.uploadAll(); err == nil {
+		t.Error("uploadAll() succeeded although the server asked to slow down")
+	}
+	if names, _ := queue.Batches(); len(names) != 1 {
+		t.Errorf("Queue has %v, want the batch to be kept for retrying", names)
+	}
+}
+
+func TestCompactUploadKeepsOnlyUnsentSamples(t *testing.T) {
+	var hosts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spans Spans
+		if err := json.NewDecoder(gz).Decode(&spans); err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, spans.Hostname)
+		switch spans.Hostname {
+		case "invalid":
+			http.Error(w, "Invalid spans", http.StatusBadRequest)
+		case "desktop":
+			http.Error(w, "Datastore unavailable", http.StatusInternalServerError)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	focused := []App{{Name: "main.go", Exec: "code"}}
+	err = queue.Push([]Sample{
+		{Time: 100, Focused: focused, Hostname: "laptop", Interval: 10000},
+		{Time: 110, Focused: focused, Hostname: "invalid", Interval: 10000},
+		{Time: 120, Focused: focused, Hostname: "desktop", Interval: 10000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := &Uploader{URL: server.URL, Queue: queue, Client: server.Client(), Compact: true}
+	if err := uploader.uploadAll(); err == nil {
+		t.Error("uploadAll() succeeded although the server failed")
+	}
+	if want := []string{"laptop", "invalid", "desktop"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Uploaded spans of %v, want %v", hosts, want)
+	}
+
+	names, _ := queue.Batches()
+	if len(names) != 1 {
+		t.Fatalf("Queue has %v, want the batch to be kept for retrying", names)
+	}
+	data, err := queue.Read(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []Sample
+	if err := json.Unmarshal(data, &left); err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].Hostname != "desktop" {
+		t.Errorf("Queue kept %+v, want only the samples of desktop", left)
+	}
+	rejected, _ := filepath.Glob(filepath.Join(dir, "rejected", "*.json"))
+	if len(rejected) != 1 {
+		t.Errorf("Quarantined %v, want the samples of invalid", rejected)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WindowSource reports which windows are open on the desktop.
+type WindowSource interface {
+	// Focused returns the window that has input focus, nil if there is none.
+	Focused() (*App, error)
+	// Visible returns all windows that are currently shown.
+	Visible() ([]App, error)
+}
+
+// IdleSource reports how long ago the user last gave any input.
+type IdleSource interface {
+	Idle() (time.Duration, error)
+}
+
+// DetectSources picks the window and idle sources matching the running desktop session.
+// idleHintDelay is the timeout after which the idle daemon of Wayland sessions marks the session as
+// idle, see logindIdle.
+func DetectSources(idleHintDelay time.Duration) (WindowSource, IdleSource, error) {
+	if os.Getenv("SWAYSOCK") != "" {
+		return swaySource{}, logindIdle{hintDelay: idleHintDelay}, nil
+	}
+	if os.Getenv("DISPLAY") != "" {
+		return x11Source{}, xprintidle{}, nil
+	}
+	return nil, nil, fmt.Errorf("Neither sway nor X11 is running")
+}
+
+// x11Source queries X11 with xdotool.
+type x11Source struct{}
+
+func (x11Source) Focused() (*App, error) {
+	out, err := exec.Command("xdotool", "getactivewindow", "getwindowname", "getwindowpid").Output()
+	if _, ok := err.(*exec.Error); ok {
+		return nil, fmt.Errorf("Failed to run xdotool: %v", err)
+	}
+	if err != nil {
+		// xdotool fails when no window is focused, e.g. on an empty desktop.
+		return nil, nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("Unexpected xdotool output %q", out)
+	}
+	pid, err := strconv.Atoi(lines[1])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse pid %q: %v", lines[1], err)
+	}
+	return &App{Name: lines[0], Exec: processName(pid)}, nil
+}
+
+func (x11Source) Visible() ([]App, error) {
+	out, err := exec.Command("xdotool", "search", "--onlyvisible", "--name", ".").Output()
+	if _, ok := err.(*exec.Error); ok {
+		return nil, fmt.Errorf("Failed to run xdotool: %v", err)
+	}
+	if err != nil {
+		// xdotool fails when it finds no windows.
+		return nil, nil
+	}
+	var apps []App
+	for _, id := range strings.Fields(string(out)) {
+		out, err := exec.Command("xdotool", "getwindowname", id, "getwindowpid", id).Output()
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(lines) != 2 {
+			continue
+		}
+		pid, _ := strconv.Atoi(lines[1])
+		apps = append(apps, App{Name: lines[0], Exec: processName(pid)})
+	}
+	return apps, nil
+}
+
+// xprintidle reads the X11 idle time.
+type xprintidle struct{}
+
+func (xprintidle) Idle() (time.Duration, error) {
+	out, err := exec.Command("xprintidle").Output()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to run xprintidle: %v", err)
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse xprintidle output %q: %v", out, err)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// swaySource queries the window tree of sway over swaymsg.
+type swaySource struct{}
+
+type swayNode struct {
+	Name          string     `json:"name"`
+	AppID         string     `json:"app_id"`
+	Pid           int        `json:"pid"`
+	Focused       bool       `json:"focused"`
+	Visible       bool       `json:"visible"`
+	Nodes         []swayNode `json:"nodes"`
+	FloatingNodes []swayNode `json:"floating_nodes"`
+}
+
+func (s swaySource) tree() (*swayNode, error) {
+	out, err := exec.Command("swaymsg", "-t", "get_tree", "-r").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to run swaymsg: %v", err)
+	}
+	var root swayNode
+	if err := json.Unmarshal(out, &root); err != nil {
+		return nil, fmt.Errorf("Failed to parse sway tree: %v", err)
+	}
+	return &root, nil
+}
+
+// windows returns all leaf nodes of the tree, which are the actual windows.
+func (n *swayNode) windows() []swayNode {
+	if len(n.Nodes) == 0 && len(n.FloatingNodes) == 0 {
+		if n.Pid == 0 {
+			return nil
+		}
+		return []swayNode{*n}
+	}
+	var windows []swayNode
+	for i := range n.Nodes {
+		windows = append(windows, n.Nodes[i].windows()...)
+	}
+	for i := range n.FloatingNodes {
+		windows = append(windows, n.FloatingNodes[i].windows()...)
+	}
+	return windows
+}
+
+func (n *swayNode) app() App {
+	process := n.AppID
+	if process == "" {
+		process = processName(n.Pid)
+	}
+	return App{Name: n.Name, Exec: process}
+}
+
+func (s swaySource) Focused() (*App, error) {
+	root, err := s.tree()
+	if err != nil {
+		return nil, err
+	}
+	for _, window := range root.windows() {
+		if window.Focused {
+			app := window.app()
+			return &app, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s swaySource) Visible() ([]App, error) {
+	root, err := s.tree()
+	if err != nil {
+		return nil, err
+	}
+	var apps []App
+	for _, window := range root.windows() {
+		if window.Visible {
+			apps = append(apps, window.app())
+		}
+	}
+	return apps, nil
+}
+
+// logindIdle reads the idle hint of the session from logind, which Wayland compositors update
+// through an idle daemon such as swayidle. Unlike xprintidle it doesn't know when the last input
+// was: the hint is only set once the daemon's timeout ran out, and IdleSinceHint is when that
+// happened. So it reports zero until then, and afterwards the time since the hint plus hintDelay,
+// which should be set to the daemon's timeout to make up for it.
+type logindIdle struct {
+	hintDelay time.Duration
+}
+
+func (l logindIdle) Idle() (time.Duration, error) {
+	out, err := exec.Command("loginctl", "show-session", "self", "--property=IdleHint",
+		"--property=IdleSinceHintMonotonic").Output()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to run loginctl: %v", err)
+	}
+	properties := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			properties[parts[0]] = parts[1]
+		}
+	}
+	if properties["IdleHint"] != "yes" {
+		return 0, nil
+	}
+	since, err := strconv.ParseInt(properties["IdleSinceHintMonotonic"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse idle hint %q: %v", properties["IdleSinceHintMonotonic"], err)
+	}
+	uptime, err := monotonicNow()
+	if err != nil {
+		return 0, err
+	}
+	return uptime - time.Duration(since)*time.Microsecond + l.hintDelay, nil
+}
+
+// monotonicNow returns the time on the monotonic clock logind uses for its idle hints.
+func monotonicNow() (time.Duration, error) {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Unexpected /proc/uptime %q", data)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// maxCommLength is the length the kernel truncates process names in /proc/<pid>/comm to.
+const maxCommLength = 15
+
+// processName returns the name of the executable of the given process, as far as it can be found.
+// Names the kernel truncated are completed from the executable, and JetBrains IDEs, which run as
+// java, are told apart by their command line.
+func processName(pid int) string {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "unknown"
+	}
+	name := string(bytes.TrimSpace(data))
+	if len(name) == maxCommLength {
+		if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil && strings.HasPrefix(filepath.Base(exe), name) {
+			name = filepath.Base(exe)
+		}
+	}
+	if name == "java" {
+		if cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+			if ide, ok := jetBrainsIDE(strings.Split(string(cmdline), "\x00")); ok {
+				name = ide
+			}
+		}
+	}
+	return name
+}
+
+// jetBrainsPrefixes maps the platform prefixes of JetBrains IDEs to the process names their native
+// launchers have.
+var jetBrainsPrefixes = map[string]string{
+	"Idea":        "idea",
+	"GoLand":      "goland",
+	"Python":      "pycharm",
+	"PyCharmCore": "pycharm",
+	"CLion":       "clion",
+}
+
+// jetBrainsIDE returns the process name of the JetBrains IDE started with the given java command
+// line, e.g. "goland" for one with -Didea.platform.prefix=GoLand. IntelliJ IDEA Ultimate has no
+// prefix.
+func jetBrainsIDE(args []string) (string, bool) {
+	isIDE := false
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-Didea.platform.prefix=") {
+			ide, ok := jetBrainsPrefixes[strings.TrimPrefix(arg, "-Didea.platform.prefix=")]
+			return ide, ok
+		}
+		if arg == "com.intellij.idea.Main" {
+			isIDE = true
+		}
+	}
+	if isIDE {
+		return "idea", true
+	}
+	return "", false
+}
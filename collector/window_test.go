@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJetBrainsIDE(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    string
+		ok      bool
+	}{
+		{"/opt/goland/jbr/bin/java\x00-Xmx2048m\x00-Didea.platform.prefix=GoLand\x00com.intellij.idea.Main", "goland", true},
+		{"/opt/pycharm/jbr/bin/java\x00-Didea.platform.prefix=Python\x00com.intellij.idea.Main", "pycharm", true},
+		{"/opt/clion/jbr/bin/java\x00-Didea.platform.prefix=CLion\x00com.intellij.idea.Main", "clion", true},
+		{"/opt/idea/jbr/bin/java\x00-Xmx2048m\x00com.intellij.idea.Main", "idea", true},
+		{"/usr/bin/java\x00-jar\x00minecraft.jar", "", false},
+	}
+	for _, test := range tests {
+		ide, ok := jetBrainsIDE(strings.Split(test.cmdline, "\x00"))
+		if ide != test.want || ok != test.ok {
+			t.Errorf("jetBrainsIDE(%q) = %q, %v, want %q, %v", test.cmdline, ide, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package common
+
+// Devices maps hostnames to the name of the device they belong to, e.g. "mononofu-x1" to
+// "work laptop". Several hostnames can map to the same device, which keeps the history of a
+// machine together after it was renamed. Hostnames that aren't listed are their own device.
+var Devices = map[string]string{}
+
+// DevicePriority lists devices in the order in which they win when several of them were in use at
+// the same time: usage of a device only counts towards the usage tree while no device before it was
+// in use. Devices that aren't listed come last, in alphabetical order.
+var DevicePriority = []string{}
+
+func Device(hostname string) string {
+	if device, ok := Devices[hostname]; ok {
+		return device
+	}
+	return hostname
+}
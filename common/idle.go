@@ -0,0 +1,71 @@
+package common
+
+import (
+	"time"
+
+	"models"
+)
+
+// IdlePolicy decides when a host counts as idle based on how long ago it last saw user input.
+type IdlePolicy struct {
+	// Timeout is the inactivity after which a host counts as idle.
+	Timeout time.Duration
+	// HostTimeouts overrides Timeout for individual hostnames.
+	HostTimeouts map[string]time.Duration
+	// AppTimeouts overrides the timeout of the host while the given process is focused. A negative
+	// timeout means the app never counts as idle, e.g. for video players or video calls.
+	AppTimeouts map[string]time.Duration
+	// MaxInactivity is the inactivity after which events are dropped when they're logged instead of
+	// being stored as idle, zero to store all events.
+	MaxInactivity time.Duration
+}
+
+var Idle = IdlePolicy{
+	Timeout: IdleTimeout,
+	AppTimeouts: map[string]time.Duration{
+		"vlc":  -1,
+		"mpv":  -1,
+		"zoom": -1,
+	},
+	MaxInactivity: time.Hour,
+}
+
+// HostTimeout returns the inactivity after which the given host counts as idle.
+func (p IdlePolicy) HostTimeout(hostname string) time.Duration {
+	if timeout, ok := p.HostTimeouts[hostname]; ok {
+		return timeout
+	}
+	return p.Timeout
+}
+
+// Inactive returns whether a sample with the given focused process and inactivity should be
+// dropped when it's logged. Apps that never count as idle are never dropped, and apps with a
+// longer timeout than MaxInactivity are only dropped after their timeout.
+func (p IdlePolicy) Inactive(process string, lastActivity time.Duration) bool {
+	if p.MaxInactivity == 0 {
+		return false
+	}
+	max := p.MaxInactivity
+	if appTimeout, ok := p.AppTimeouts[process]; ok {
+		if appTimeout < 0 {
+			return false
+		}
+		if appTimeout > max {
+			max = appTimeout
+		}
+	}
+	return lastActivity >= max
+}
+
+// IdleSince returns since when the host had been without input at the last sample of span, if that
+// was long enough for it to count as idle.
+func (p IdlePolicy) IdleSince(span models.Span) (time.Time, bool) {
+	timeout := p.HostTimeout(span.Hostname)
+	if appTimeout, ok := p.AppTimeouts[span.Focused.Process]; ok {
+		timeout = appTimeout
+	}
+	if timeout < 0 || span.LastActivity < timeout {
+		return time.Time{}, false
+	}
+	return LastSample(span).Add(-span.LastActivity), true
+}
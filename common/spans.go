@@ -0,0 +1,132 @@
+package common
+
+import (
+	"sort"
+	"time"
+
+	"models"
+)
+
+// sampleJitter is how far the time since the last activity may deviate from what is expected for
+// samples to still be joined into the same span, since sample times are rounded to seconds.
+const sampleJitter = 2 * time.Second
+
+// SampleSpan returns a span made up of just the given sample.
+func SampleSpan(usage models.Usage) models.Span {
+	interval := usage.Interval
+	if interval <= 0 {
+		interval = LogInterval
+	}
+	return models.Span{
+		Start:        usage.At,
+		End:          usage.At.Add(interval),
+		Focused:      usage.Focused,
+		LastActivity: usage.LastActivity,
+		Hostname:     usage.Hostname,
+		Interval:     interval,
+	}
+}
+
+// LastSample returns the time of the last sample of span.
+func LastSample(span models.Span) time.Time {
+	return span.End.Add(-span.Interval)
+}
+
+// firstActivity returns the time since the last activity at the first sample of span.
+func firstActivity(span models.Span) time.Duration {
+	lastActivity := span.LastActivity - LastSample(span).Sub(span.Start)
+	if lastActivity < 0 {
+		return 0
+	}
+	return lastActivity
+}
+
+// Join returns a and b joined into one span if b directly continues a: it must be on the same host
+// and window, start one interval after the last sample of a, and the time since the last activity
+// at its first sample must be consistent with a.
+func Join(a, b models.Span) (models.Span, bool) {
+	if a.Hostname != b.Hostname || a.Focused != b.Focused || a.Interval != b.Interval {
+		return a, false
+	}
+	gap := b.Start.Sub(LastSample(a))
+	if gap <= 0 || gap > a.Interval*3/2 {
+		return a, false
+	}
+
+	first := firstActivity(b)
+	// Either the user was active at the end of a and the beginning of b...
+	active := a.LastActivity < a.Interval && first < gap+sampleJitter
+	// ...or there was no activity in between, so the time since the last activity kept growing.
+	growth := first - (a.LastActivity + gap)
+	idle := growth > -sampleJitter && growth < sampleJitter
+	if !active && !idle {
+		return a, false
+	}
+
+	a.End = b.End
+	a.LastActivity = b.LastActivity
+	return a, true
+}
+
+// Coalesce joins all spans that continue each other. The result is sorted by hostname and start.
+func Coalesce(spans []models.Span) []models.Span {
+	sorted := make([]models.Span, len(spans))
+	copy(sorted, spans)
+	sort.Sort(byHostnameAndStart(sorted))
+
+	var coalesced []models.Span
+	for _, span := range sorted {
+		if len(coalesced) > 0 {
+			if joined, ok := Join(coalesced[len(coalesced)-1], span); ok {
+				coalesced[len(coalesced)-1] = joined
+				continue
+			}
+		}
+		coalesced = append(coalesced, span)
+	}
+	return coalesced
+}
+
+// HourlySpans returns the spans of hourlyUsage, including the ones of samples that haven't been
+// migrated to spans yet.
+func HourlySpans(hourlyUsage models.HourlyUsage) []models.Span {
+	if len(hourlyUsage.Events) == 0 {
+		return hourlyUsage.Spans
+	}
+	spans := append([]models.Span{}, hourlyUsage.Spans...)
+	for _, event := range hourlyUsage.Events {
+		spans = append(spans, SampleSpan(event))
+	}
+	return Coalesce(spans)
+}
+
+// SpanEnd returns when span ends at view time, given the following span of the same device, nil if
+// there is none. Spans last until the next one starts, to make up for missed samples, but at most
+// the idle timeout of the host after their last sample.
+func SpanEnd(span models.Span, next *models.Span) time.Time {
+	end := span.End
+	if next != nil {
+		end = next.Start
+	}
+	if limit := LastSample(span).Add(Idle.HostTimeout(span.Hostname)); end.After(limit) {
+		end = limit
+	}
+	return end
+}
+
+type ByStart []models.Span
+
+func (a ByStart) Len() int           { return len(a) }
+func (a ByStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByStart) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
+
+type byHostnameAndStart []models.Span
+
+func (a byHostnameAndStart) Len() int      { return len(a) }
+func (a byHostnameAndStart) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byHostnameAndStart) Less(i, j int) bool {
+	if a[i].Hostname != a[j].Hostname {
+		return a[i].Hostname < a[j].Hostname
+	}
+	return a[i].Start.Before(a[j].Start)
+}
@@ -0,0 +1,77 @@
+package usage
+
+import (
+	"fmt"
+)
+
+// spansContentType marks /log/ requests that use the compact span format instead of a list of
+// RawUsage.
+const spansContentType = "application/vnd.app-usage.spans+json"
+
+// maxSpanCount limits how many samples a single span can stand for, a day's worth at 10 seconds.
+const maxSpanCount = 24 * 60 * 6
+
+// maxExpandedCount limits how many samples a request to /log/ can contain, counting each sample
+// that its spans stand for.
+const maxExpandedCount = 2 * maxSpanCount
+
+// maxSpanLength limits the time a single span can cover, in milliseconds.
+const maxSpanLength = 24 * 60 * 60 * 1000
+
+// RawSpans is the compact upload format. Consecutive samples of the same host with the same focused
+// window are collapsed into a single RawSpan.
+type RawSpans struct {
+	Hostname string
+	Interval float64 `json:"interval_ms"`
+	Spans    []RawSpan
+}
+
+// RawSpan stands for Count samples taken Interval apart, starting at Time. Between samples the
+// time since the last activity grows by the interval, so only the last activity at the last sample
+// is sent and it is clamped at zero for the samples before, where the user was active.
+type RawSpan struct {
+	Time         float64
+	Count        int
+	Focused      RawApp
+	LastActivity float64 `json:"last_activity_ms"`
+	Interval     float64 `json:"interval_ms"` // Overrides the interval of RawSpans if set
+}
+
+// expand turns spans back into the samples they stand for.
+func (s RawSpans) expand() ([]RawUsage, error) {
+	var usages []RawUsage
+	total := 0
+	for i, span := range s.Spans {
+		if span.Count < 1 || span.Count > maxSpanCount {
+			return nil, fmt.Errorf("Span %d has invalid count %d", i, span.Count)
+		}
+		total += span.Count
+		if total > maxExpandedCount {
+			return nil, fmt.Errorf("Spans stand for more than %d samples", maxExpandedCount)
+		}
+		interval := span.Interval
+		if interval == 0 {
+			interval = s.Interval
+		}
+		if span.Count > 1 && interval <= 0 {
+			return nil, fmt.Errorf("Span %d has %d samples but no interval", i, span.Count)
+		}
+		if float64(span.Count-1)*interval > maxSpanLength {
+			return nil, fmt.Errorf("Span %d is longer than %v ms", i, maxSpanLength)
+		}
+		for j := 0; j < span.Count; j++ {
+			lastActivity := span.LastActivity - float64(span.Count-1-j)*interval
+			if lastActivity < 0 {
+				lastActivity = 0
+			}
+			usages = append(usages, RawUsage{
+				Time:         span.Time + float64(j)*interval/1000,
+				Focused:      []RawApp{span.Focused},
+				LastActivity: lastActivity,
+				Hostname:     s.Hostname,
+				Interval:     interval,
+			})
+		}
+	}
+	return usages, nil
+}
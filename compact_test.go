@@ -0,0 +1,63 @@
+package usage
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandRoundTrip(t *testing.T) {
+	// Two samples of an active user followed by three of one who went away, as sent by the collector.
+	body := `{"Hostname": "laptop", "Spans": [
+		{"Time": 100, "Count": 2, "Focused": {"Name": "a.go", "Exec": "code"}, "last_activity_ms": 500, "interval_ms": 10000},
+		{"Time": 120, "Count": 3, "Focused": {"Name": "b.go", "Exec": "code"}, "last_activity_ms": 25000, "interval_ms": 10000}
+	]}`
+	var spans RawSpans
+	if err := json.Unmarshal([]byte(body), &spans); err != nil {
+		t.Fatal(err)
+	}
+	usages, err := spans.expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := []RawApp{{Name: "a.go", Exec: "code"}}
+	b := []RawApp{{Name: "b.go", Exec: "code"}}
+	want := []RawUsage{
+		{Time: 100, Focused: a, LastActivity: 0, Hostname: "laptop", Interval: 10000},
+		{Time: 110, Focused: a, LastActivity: 500, Hostname: "laptop", Interval: 10000},
+		{Time: 120, Focused: b, LastActivity: 5000, Hostname: "laptop", Interval: 10000},
+		{Time: 130, Focused: b, LastActivity: 15000, Hostname: "laptop", Interval: 10000},
+		{Time: 140, Focused: b, LastActivity: 25000, Hostname: "laptop", Interval: 10000},
+	}
+	if !reflect.DeepEqual(usages, want) {
+		t.Errorf("expand() = %+v, want %+v", usages, want)
+	}
+}
+
+func TestExpandRejectsImplausibleSpans(t *testing.T) {
+	tests := []struct {
+		name  string
+		spans RawSpans
+		err   string
+	}{
+		{"no samples", RawSpans{Spans: []RawSpan{{Count: 0}}}, "invalid count"},
+		{"too many samples in a span", RawSpans{Interval: 1, Spans: []RawSpan{{Count: maxSpanCount + 1}}}, "invalid count"},
+		{"no interval", RawSpans{Spans: []RawSpan{{Count: 2}}}, "no interval"},
+		{"too long", RawSpans{Spans: []RawSpan{{Count: 2, Interval: maxSpanLength + 1}}}, "longer than"},
+		{"too many samples in total", RawSpans{Interval: 1, Spans: []RawSpan{
+			{Count: maxSpanCount}, {Count: maxSpanCount}, {Count: 1},
+		}}, "more than"},
+	}
+	for _, test := range tests {
+		usages, err := test.spans.expand()
+		if err == nil {
+			t.Errorf("%s: expand() returned %d samples, want an error", test.name, len(usages))
+			continue
+		}
+		if !strings.Contains(strings.ToLower(err.Error()), test.err) {
+			t.Errorf("%s: expand() = %q, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
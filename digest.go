@@ -0,0 +1,437 @@
+package usage
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+
+	"models"
+	"usage"
+)
+
+// DigestRecipient says which digests are mailed to whom.
+type DigestRecipient struct {
+	// Email is the address to send the digests to, empty to send them to the admins of the app.
+	Email  string
+	Daily  bool
+	Weekly bool
+	// TopCategories is the number of categories listed in the digest.
+	TopCategories int
+}
+
+var digestRecipients = []DigestRecipient{
+	{Daily: true, Weekly: true, TopCategories: 5},
+}
+
+var digestTemplate = template.Must(template.ParseFiles("templates/digest.html"))
+
+// Size of the chart in digests, in pixels.
+const (
+	digestChartWidth  = 480
+	digestChartHeight = 80
+)
+
+func init() {
+	http.HandleFunc("/cron/digest/", digestCronHandler)
+	http.HandleFunc("/cron/summary/", summaryCronHandler)
+}
+
+// digestSummary is what happened during the period covered by a digest.
+type digestSummary struct {
+	WallClock  time.Duration
+	Categories map[string]time.Duration // By the first two levels of the usage tree, e.g. chrome/github
+	Piano      time.Duration
+	Commute    time.Duration
+	// Buckets is the wall clock time per hour for daily digests, and per day for weekly ones.
+	Buckets []time.Duration
+	// RulesVersion is the version of the rules the usage was categorized with, 0 for the built-in
+	// rules.
+	RulesVersion int64
+}
+
+// DigestCategory is a category listed in a digest.
+type DigestCategory struct {
+	Name     string
+	Duration time.Duration
+	Change   string
+}
+
+// sendDigest mails msg to the given address, or to the admins if it's empty. Tests replace it to
+// check digests without sending mail, see digest_test.go.
+var sendDigest = func(c appengine.Context, msg *mail.Message, to string) error {
+	if to == "" {
+		return mail.SendToAdmins(c, msg)
+	}
+	msg.To = []string{to}
+	return mail.Send(c, msg)
+}
+
+// digestCronHandler mails the daily digest covering yesterday, or with period=weekly, the weekly
+// digest covering the last seven days, to all recipients that want it.
+func digestCronHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	today := BeginningOfDay(time.Now().In(loc))
+	weekly := false
+	days := 1
+	switch r.FormValue("period") {
+	case "", "daily":
+	case "weekly":
+		weekly = true
+		days = 7
+	default:
+		http.Error(w, fmt.Sprintf("Unknown period %q", r.FormValue("period")), http.StatusBadRequest)
+		return
+	}
+
+	var recipients []DigestRecipient
+	for _, recipient := range digestRecipients {
+		if (weekly && recipient.Weekly) || (!weekly && recipient.Daily) {
+			recipients = append(recipients, recipient)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	from := today.AddDate(0, 0, -days)
+	current, err := summarize(c, from, days, weekly)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("%v", err)
+		return
+	}
+	// Daily digests are compared to the same day of the previous week, weekly ones to the previous
+	// week.
+	previous, err := summarize(c, from.AddDate(0, 0, -7), days, weekly)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("%v", err)
+		return
+	}
+
+	chart, err := digestChart(current.Buckets)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to draw chart: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var title string
+	if weekly {
+		title = fmt.Sprintf("Week from %s to %s", from.Format("Mon Jan 2"), today.AddDate(0, 0, -1).Format("Mon Jan 2"))
+	} else {
+		title = from.Format("Monday, January 2")
+	}
+	if err := mailDigests(c, recipients, title, weekly, from, current, previous, chart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("%v", err)
+		return
+	}
+}
+
+func sentDigestKey(c appengine.Context, period string, from time.Time, recipient string) *datastore.Key {
+	return datastore.NewKey(c, "SentDigest", fmt.Sprintf("%s/%s/%s", period, from.Format("2006-01-02"), recipient), 0, nil)
+}
+
+// mailDigests mails the digest of the period starting at from to each of recipients that didn't
+// get it yet, and records who got it.
+func mailDigests(c appengine.Context, recipients []DigestRecipient, title string, weekly bool, from time.Time, current, previous *digestSummary, chart []byte) error {
+	period := "daily"
+	if weekly {
+		period = "weekly"
+	}
+	for _, recipient := range recipients {
+		key := sentDigestKey(c, period, from, recipient.Email)
+		var sent models.SentDigest
+		if err := datastore.Get(c, key, &sent); err == nil {
+			continue
+		} else if err != datastore.ErrNoSuchEntity {
+			return fmt.Errorf("Failed to check whether the digest was sent: %v", err)
+		}
+
+		data := make(map[string]interface{})
+		data["Title"] = title
+		data["Weekly"] = weekly
+		data["WallClock"] = roundMinutes(current.WallClock)
+		data["WallClockChange"] = change(current.WallClock, previous.WallClock)
+		data["Categories"] = topCategories(current, previous, recipient.TopCategories)
+		data["Piano"] = roundMinutes(current.Piano)
+		data["PianoChange"] = change(current.Piano, previous.Piano)
+		data["Commute"] = roundMinutes(current.Commute)
+		data["CommuteChange"] = change(current.Commute, previous.Commute)
+		data["Rules"] = rulesVersionName(current.RulesVersion)
+
+		var body bytes.Buffer
+		if err := digestTemplate.Execute(&body, data); err != nil {
+			return fmt.Errorf("Failed to render digest: %v", err)
+		}
+
+		msg := &mail.Message{
+			Sender:   fmt.Sprintf("App Usage <digest@%s.appspotmail.com>", appengine.AppID(c)),
+			Subject:  fmt.Sprintf("%s: %s in use", title, roundMinutes(current.WallClock)),
+			Body:     fmt.Sprintf("%s in use, %s of piano practice, %s commuting.\n\nCategorized with %s.", roundMinutes(current.WallClock), roundMinutes(current.Piano), roundMinutes(current.Commute), rulesVersionName(current.RulesVersion)),
+			HTMLBody: body.String(),
+			Attachments: []mail.Attachment{
+				{Name: "chart.png", Data: chart, ContentID: "<chart>"},
+			},
+		}
+		if err := sendDigest(c, msg, recipient.Email); err != nil {
+			return fmt.Errorf("Failed to send digest: %v", err)
+		}
+		sent = models.SentDigest{
+			Period:       period,
+			From:         from,
+			Recipient:    recipient.Email,
+			Sent:         time.Now(),
+			RulesVersion: current.RulesVersion,
+		}
+		if _, err := datastore.Put(c, key, &sent); err != nil {
+			return fmt.Errorf("Failed to record sent digest: %v", err)
+		}
+	}
+	return nil
+}
+
+// summaryCronHandler runs after the end of each day and sends the summary of the previous day to
+// webhooks.
+func summaryCronHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !subscribed(eventSummaryFinalized) {
+		return
+	}
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	day := BeginningOfDay(time.Now().In(loc)).AddDate(0, 0, -1)
+	summary, err := summarize(c, day, 1, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("%v", err)
+		return
+	}
+
+	categories := make(map[string]int64)
+	for name, duration := range summary.Categories {
+		categories[name] = int64(duration.Seconds())
+	}
+	err = fireEvent(c, eventSummaryFinalized, map[string]interface{}{
+		"date":               day.Format("2006-01-02"),
+		"wall_clock_seconds": int64(summary.WallClock.Seconds()),
+		"piano_seconds":      int64(summary.Piano.Seconds()),
+		"commute_seconds":    int64(summary.Commute.Seconds()),
+		"category_seconds":   categories,
+		"rules_version":      summary.RulesVersion,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Errorf("%v", err)
+		return
+	}
+}
+
+// summarize sums up the given number of days starting at from. Usage is counted like on the graph
+// page, one day at a time.
+func summarize(c appengine.Context, from time.Time, days int, weekly bool) (*digestSummary, error) {
+	to := from.AddDate(0, 0, days)
+	summary := &digestSummary{Categories: make(map[string]time.Duration)}
+
+	var boundaries []time.Time
+	if weekly {
+		for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+			boundaries = append(boundaries, day)
+		}
+	} else {
+		for hour := from; !hour.After(to); hour = hour.Add(time.Hour) {
+			boundaries = append(boundaries, hour)
+		}
+	}
+
+	rules, err := loadRules(c, 0)
+	if err != nil {
+		return nil, err
+	}
+	summary.RulesVersion = rules.Version
+	var allPeriods []period
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		usages, err := queryUsage(c, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query usage logs: %v", err)
+		}
+		meetings, err := queryMeetings(c, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query meetings: %v", err)
+		}
+		annotations, _, err := queryAnnotations(c, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query annotations: %v", err)
+		}
+		logger, err := usage.MakeLogger(rules.Rules, usage.DefaultEditorDepth)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create logger: %v", err)
+		}
+		categories := &categoryLogger{Logger: logger, depth: 2, durations: summary.Categories}
+		spansByDevice, _ := filterIdles(usages)
+		annotated := addDayUsage(categories, day, spansByDevice, devicePriority("", spansByDevice), meetings, annotations)
+		for _, spans := range spansByDevice {
+			allPeriods = append(allPeriods, spanPeriods(spans)...)
+		}
+		allPeriods = append(allPeriods, annotated...)
+	}
+	for _, p := range mergePeriods(allPeriods) {
+		summary.WallClock += p.End.Sub(p.Start)
+	}
+	summary.Buckets = bucketDurations(mergePeriods(allPeriods), boundaries)
+
+	pieces, err := queryPieces(c, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query midi logs: %v", err)
+	}
+	for _, piece := range pieces {
+		summary.Piano += piece.Length
+	}
+
+	q := datastore.NewQuery("Tube").
+		Filter("Start >=", from).
+		Filter("Start <", to).
+		Order("Start")
+	var tubes []models.Tube
+	if _, err := q.GetAll(c, &tubes); err != nil {
+		return nil, fmt.Errorf("Failed to query tube journeys: %v", err)
+	}
+	for _, tube := range tubes {
+		summary.Commute += tube.End.Sub(tube.Start)
+	}
+	return summary, nil
+}
+
+// categoryLogger sums up time by the first depth levels of the category of each span.
+type categoryLogger struct {
+	usage.Logger
+	depth     int
+	durations map[string]time.Duration
+}
+
+func (l *categoryLogger) AddSpan(span models.Span) {
+	category := l.Category(span)
+	if len(category) > l.depth {
+		category = category[:l.depth]
+	}
+	l.durations[strings.Join(category, "/")] += span.End.Sub(span.Start)
+}
+
+// bucketDurations returns how much of periods, which must be sorted and must not overlap, falls
+// between each pair of consecutive boundaries.
+func bucketDurations(periods []period, boundaries []time.Time) []time.Duration {
+	if len(boundaries) < 2 {
+		return nil
+	}
+	buckets := make([]time.Duration, len(boundaries)-1)
+	for i := range buckets {
+		for _, p := range periods {
+			start, end := p.Start, p.End
+			if start.Before(boundaries[i]) {
+				start = boundaries[i]
+			}
+			if end.After(boundaries[i+1]) {
+				end = boundaries[i+1]
+			}
+			if end.After(start) {
+				buckets[i] += end.Sub(start)
+			}
+		}
+	}
+	return buckets
+}
+
+func topCategories(current, previous *digestSummary, n int) []DigestCategory {
+	var categories []DigestCategory
+	for name, duration := range current.Categories {
+		categories = append(categories, DigestCategory{
+			Name:     name,
+			Duration: roundMinutes(duration),
+			Change:   change(duration, previous.Categories[name]),
+		})
+	}
+	sort.Sort(byCategoryDuration(categories))
+	if len(categories) > n {
+		categories = categories[:n]
+	}
+	return categories
+}
+
+// change describes how current differs from previous, e.g. "+1h5m0s".
+func change(current, previous time.Duration) string {
+	diff := roundMinutes(current) - roundMinutes(previous)
+	switch {
+	case diff > 0:
+		return "+" + diff.String()
+	case diff < 0:
+		return diff.String()
+	}
+	return "±0"
+}
+
+func roundMinutes(d time.Duration) time.Duration {
+	return (d + time.Minute/2) / time.Minute * time.Minute
+}
+
+// digestChart draws a bar chart of buckets as PNG.
+func digestChart(buckets []time.Duration) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, digestChartWidth, digestChartHeight))
+	background := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	bar := color.RGBA{0x31, 0x82, 0xbd, 0xff}
+	for x := 0; x < digestChartWidth; x++ {
+		for y := 0; y < digestChartHeight; y++ {
+			img.Set(x, y, background)
+		}
+	}
+
+	var max time.Duration
+	for _, b := range buckets {
+		if b > max {
+			max = b
+		}
+	}
+	if max > 0 {
+		width := digestChartWidth / len(buckets)
+		for i, b := range buckets {
+			height := int(int64(digestChartHeight) * int64(b) / int64(max))
+			for x := i*width + 1; x < (i+1)*width-1; x++ {
+				for y := digestChartHeight - height; y < digestChartHeight; y++ {
+					img.Set(x, y, bar)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type byCategoryDuration []DigestCategory
+
+func (a byCategoryDuration) Len() int           { return len(a) }
+func (a byCategoryDuration) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCategoryDuration) Less(i, j int) bool { return a[i].Duration > a[j].Duration }
@@ -0,0 +1,87 @@
+package usage
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/mail"
+)
+
+func TestMailDigestsSendsEachRecipientOnce(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var sent []*mail.Message
+	var sentTo []string
+	failFor := "b@example.com"
+	original := sendDigest
+	defer func() { sendDigest = original }()
+	sendDigest = func(c appengine.Context, msg *mail.Message, to string) error {
+		if to == failFor {
+			return errors.New("Mail quota exceeded")
+		}
+		sent = append(sent, msg)
+		sentTo = append(sentTo, to)
+		return nil
+	}
+
+	recipients := []DigestRecipient{
+		{Email: "a@example.com", Daily: true, TopCategories: 1},
+		{Email: "b@example.com", Daily: true, TopCategories: 1},
+	}
+	current := &digestSummary{
+		WallClock:    3 * time.Hour,
+		Categories:   map[string]time.Duration{"chrome/github": 2 * time.Hour, "vscode/app-usage": time.Hour},
+		Piano:        30 * time.Minute,
+		Commute:      40 * time.Minute,
+		Buckets:      []time.Duration{time.Hour, 2 * time.Hour},
+		RulesVersion: 3,
+	}
+	previous := &digestSummary{Categories: map[string]time.Duration{"chrome/github": time.Hour}}
+	chart, err := digestChart(current.Buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	if err := mailDigests(c, recipients, "Monday, January 2", false, from, current, previous, chart); err == nil {
+		t.Fatal("mailDigests() succeeded although sending to b@example.com failed")
+	}
+	if len(sent) != 1 {
+		t.Fatalf("mailDigests() sent %d digests, want 1", len(sent))
+	}
+	msg := sent[0]
+	if want := "Monday, January 2: 3h0m0s in use"; msg.Subject != want {
+		t.Errorf("Subject = %q, want %q", msg.Subject, want)
+	}
+	for _, want := range []string{"3h0m0s in use", "30m0s of piano practice", "40m0s commuting", "rules version 3"} {
+		if !strings.Contains(msg.Body, want) {
+			t.Errorf("Body = %q, want it to contain %q", msg.Body, want)
+		}
+	}
+	if !strings.Contains(msg.HTMLBody, "chrome/github") || strings.Contains(msg.HTMLBody, "vscode/app-usage") {
+		t.Errorf("HTMLBody = %q, want only the top category chrome/github", msg.HTMLBody)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].ContentID != "<chart>" ||
+		!bytes.Equal(msg.Attachments[0].Data, chart) {
+		t.Errorf("Attachments = %+v, want the chart", msg.Attachments)
+	}
+
+	// Retrying only sends the digest to the recipient that didn't get it yet.
+	failFor = ""
+	if err := mailDigests(c, recipients, "Monday, January 2", false, from, current, previous, chart); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a@example.com", "b@example.com"}; !reflect.DeepEqual(sentTo, want) {
+		t.Errorf("Digests were sent to %v, want %v", sentTo, want)
+	}
+}
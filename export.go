@@ -0,0 +1,144 @@
+package usage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"models"
+	"usage"
+)
+
+func init() {
+	http.HandleFunc("/export/", exportHandler)
+}
+
+// Interval is a contiguous period of time during which a host was focused on the same window.
+type Interval struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Device   string    `json:"device"`
+	Hostname string    `json:"hostname"`
+	Process  string    `json:"process"`
+	Title    string    `json:"title"`
+	Category string    `json:"category"`
+}
+
+// exportHandler writes all non-idle usage in a date range as one row per interval, either as CSV or
+// as JSON lines. Usage is read and written one day at a time so that long ranges don't have to fit
+// into memory.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := parseDateRange(r, loc, 7)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rules, err := requestRules(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger, err := usage.MakeLogger(rules.Rules, usage.DefaultEditorDepth)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create logger: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var write func(Interval) error
+	var flush func() error
+	switch r.FormValue("format") {
+	case "", "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=usage.csv")
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"start", "end", "device", "hostname", "process", "title", "category"})
+		write = func(i Interval) error {
+			return writer.Write([]string{i.Start.Format(time.RFC3339), i.End.Format(time.RFC3339),
+				i.Device, i.Hostname, i.Process, i.Title, i.Category})
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=usage.jsonl")
+		encoder := json.NewEncoder(w)
+		write = func(i Interval) error { return encoder.Encode(i) }
+		flush = func() error { return nil }
+	default:
+		http.Error(w, fmt.Sprintf("Unknown format %q", r.FormValue("format")), http.StatusBadRequest)
+		return
+	}
+
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		end := day.AddDate(0, 0, 1)
+		if end.After(to) {
+			end = to
+		}
+		usages, err := queryUsage(c, day, end)
+		if err != nil {
+			c.Errorf("Failed to query usage logs for %s: %v", day, err)
+			return
+		}
+
+		spansByDevice, _ := filterIdles(usages)
+		for _, interval := range spanIntervals(spansByDevice, logger) {
+			if err := write(interval); err != nil {
+				c.Errorf("Failed to write export: %v", err)
+				return
+			}
+		}
+		if err := flush(); err != nil {
+			c.Errorf("Failed to write export: %v", err)
+			return
+		}
+	}
+}
+
+// spanIntervals joins consecutive spans of a device that were focused on the same window into
+// intervals, sorted by start.
+func spanIntervals(spansByDevice map[string][]models.Span, logger usage.Logger) []Interval {
+	var intervals []Interval
+	for device, spans := range spansByDevice {
+		var last *Interval
+		for _, span := range spans {
+			if last != nil && !span.Start.After(last.End) && last.Hostname == span.Hostname &&
+				last.Process == span.Focused.Process && last.Title == span.Focused.WindowTitle {
+				last.End = span.End
+				continue
+			}
+			intervals = append(intervals, Interval{
+				Start:    span.Start,
+				End:      span.End,
+				Device:   device,
+				Hostname: span.Hostname,
+				Process:  span.Focused.Process,
+				Title:    span.Focused.WindowTitle,
+				Category: strings.Join(logger.Category(span), "/"),
+			})
+			last = &intervals[len(intervals)-1]
+		}
+	}
+	sort.Sort(byIntervalStart(intervals))
+	return intervals
+}
+
+type byIntervalStart []Interval
+
+func (a byIntervalStart) Len() int           { return len(a) }
+func (a byIntervalStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byIntervalStart) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
@@ -1,6 +1,7 @@
 package usage
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -18,10 +19,13 @@ import (
 
 var graphTemplate = template.Must(template.ParseFiles("templates/graph.html"))
 
+// maxUnclassified is the number of unclassified categories listed for scoring on the graph page.
+const maxUnclassified = 10
+
 func graphHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
-	loc, err := time.LoadLocation("Europe/London")
+	loc, err := location()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
 		return
@@ -38,47 +42,79 @@ func graphHandler(w http.ResponseWriter, r *http.Request) {
 		day = BeginningOfDay(time.Unix(i, 0).In(loc))
 	}
 
-	q := datastore.NewQuery("HourlyUsage").
-		Filter("At >=", day).
-		Filter("At <", day.Add(time.Hour*24)).
-		Order("At")
-	var usages []models.HourlyUsage
-	_, err = q.GetAll(c, &usages)
+	usages, err := queryUsage(c, day, day.Add(time.Hour*24))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to query usage logs: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	q = datastore.NewQuery("Piece").
-		Filter("Start >=", day).
-		Filter("Start <", day.Add(time.Hour*24)).
-		Order("Start")
-	var pieces []models.Piece
-	_, err = q.GetAll(c, &pieces)
+	pieces, err := queryPieces(c, day, day.Add(time.Hour*24))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to query midi logs: %v", err), http.StatusInternalServerError)
 		return
 	}
+	meetings, err := queryMeetings(c, day, day.Add(time.Hour*24))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query meetings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	annotations, annotationKeys, err := queryAnnotations(c, day, day.Add(time.Hour*24))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query annotations: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	logger, timestampByHostname, err := filterIdles(usages)
+	rules, err := requestRules(c, r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to filter usage: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	allIntervals, total := calculateIntervals(day, timestampByHostname)
+	editorDepth := usage.DefaultEditorDepth
+	if r.FormValue("depth") != "" {
+		editorDepth, err = strconv.Atoi(r.FormValue("depth"))
+		if err != nil || editorDepth < usage.EditorProject || editorDepth > usage.EditorFile {
+			http.Error(w, fmt.Sprintf("Invalid depth %q", r.FormValue("depth")), http.StatusBadRequest)
+			return
+		}
+	}
+	byDevice := r.FormValue("by") == "device"
+	var logger usage.Logger
+	if byDevice {
+		logger, err = usage.MakeDeviceLogger(rules.Rules, editorDepth)
+	} else {
+		logger, err = usage.MakeLogger(rules.Rules, editorDepth)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create logger: %v", err), http.StatusInternalServerError)
+		return
+	}
+	productivity, err := usage.MakeProductivityLogger(logger, rules.Rules, rules.Productivity)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create logger: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logger = productivity
+
+	spansByDevice, idleByDevice := filterIdles(usages)
+	priority := devicePriority(r.FormValue("prefer"), spansByDevice)
+	annotated := addDayUsage(logger, day, spansByDevice, priority, meetings, annotations)
+
+	periodsByDevice := make(map[string][]period)
+	for device, spans := range spansByDevice {
+		periodsByDevice[device] = spanPeriods(spans)
+	}
+	if len(annotated) > 0 {
+		periodsByDevice[usage.AnnotationHostname] = annotated
+	}
+	allIntervals, total, wallClock := calculateIntervals(day, periodsByDevice)
 
 	// Make the logger believe midi notes are app usage.
 	var pianoIntervals []map[string]int64
 	for _, piece := range pieces {
-		curPos := piece.Start
-		end := curPos.Add(piece.Length)
-		for curPos.Before(end) {
-			logger.AddUsage(models.Usage{Focused: models.App{Process: "piano"}})
-			curPos = curPos.Add(common.LogInterval)
-		}
+		logger.AddSpan(pieceSpan(piece))
 		pianoIntervals = append(pianoIntervals, map[string]int64{
 			"starting_time": piece.Start.Unix() * 1000,
-			"ending_time":   end.Unix() * 1000,
+			"ending_time":   piece.Start.Add(piece.Length).Unix() * 1000,
 		})
 	}
 	if pianoIntervals != nil {
@@ -87,12 +123,90 @@ func graphHandler(w http.ResponseWriter, r *http.Request) {
 			"times": pianoIntervals,
 		})
 	}
+	if len(meetings) > 0 {
+		allIntervals = append(allIntervals, meetingIntervals(meetings))
+	}
+
+	includeIdle := r.FormValue("idle") == "include"
+	tree := logger.Serialize()
+	if includeIdle {
+		// Show what was filtered out as a separate subtree and separate timeline tracks.
+		idleLogger, err := usage.MakeLogger(rules.Rules, editorDepth)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create logger: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for device, spans := range idleByDevice {
+			for _, span := range spans {
+				idleLogger.AddSpan(span)
+			}
+			var intervals []map[string]int64
+			for _, s := range mergePeriods(spanPeriods(spans)) {
+				intervals = append(intervals, map[string]int64{
+					"starting_time": s.Start.Unix() * 1000,
+					"ending_time":   s.End.Unix() * 1000,
+				})
+			}
+			allIntervals = append(allIntervals, map[string]interface{}{
+				"label": device + " (idle)",
+				"times": intervals,
+			})
+		}
+		idleTree := idleLogger.Serialize()
+		idleTree["name"] = "idle"
+		tree["children"] = append(tree["children"].([]interface{}), idleTree)
+	}
+
+	report := productivity.Report(maxUnclassified)
+
+	// The live view reloads the graph of the current day in this format.
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"usage":        tree,
+			"intervals":    allIntervals,
+			"total":        total.String(),
+			"wall_clock":   wallClock.String(),
+			"productivity": report,
+		})
+		if err != nil {
+			c.Errorf("Failed to write graph: %v", err)
+		}
+		return
+	}
 
 	data := make(map[string]interface{})
-	data["Usage"] = logger.Serialize()
+	data["Live"] = r.FormValue("live") != "" && day.Equal(newestDay)
+	data["Depth"] = editorDepth
+	data["DefaultDepth"] = usage.DefaultEditorDepth
+	data["Usage"] = tree
 	data["Intervals"] = allIntervals
+	data["Productivity"] = report
+	// Only keep the rules version in links if it was pinned.
+	if r.FormValue("rules") != "" {
+		data["Rules"] = rules.Version
+	} else {
+		data["Rules"] = 0
+	}
+	var annotationData []map[string]interface{}
+	for i, annotation := range annotations {
+		annotationData = append(annotationData, map[string]interface{}{
+			"ID":       annotationKeys[i].IntID(),
+			"Start":    annotation.Start.In(loc).Format("2006-01-02T15:04"),
+			"End":      annotation.End.In(loc).Format("2006-01-02T15:04"),
+			"Label":    annotation.Label,
+			"Category": annotation.Category,
+		})
+	}
+	data["Annotations"] = annotationData
+	data["URL"] = r.URL.RequestURI()
 	data["Total"] = total
+	data["WallClock"] = wallClock
+	data["Devices"] = priority
+	data["Prefer"] = r.FormValue("prefer")
 	data["Date"] = day.Format("2006-01-02")
+	data["ByDevice"] = byDevice
+	data["IncludeIdle"] = includeIdle
 	data["Timestamp"] = day.Unix()
 	data["NewestTimestamp"] = newestDay.Unix()
 	data["OldestTimestamp"] = 1396738800
@@ -103,51 +217,168 @@ func graphHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func filterIdles(usages []models.HourlyUsage) (usage.Logger, map[string][]int64, error) {
-	logger, err := usage.MakeLogger()
-	if err != nil {
-		return nil, nil, err
+// pieceSpan returns a span for piece, so that piano practice shows up like app usage.
+func pieceSpan(piece models.Piece) models.Span {
+	return models.Span{
+		Start:    piece.Start,
+		End:      piece.Start.Add(piece.Length),
+		Hostname: "piano",
+		Focused:  models.App{Process: "piano"},
+	}
+}
+
+func clampTime(t, min, max time.Time) time.Time {
+	if t.Before(min) {
+		return min
 	}
+	if t.After(max) {
+		return max
+	}
+	return t
+}
 
-	usageByHostname := make(map[string][]models.Usage)
+// period is a period of time during which a device was in use.
+type period struct {
+	Start time.Time
+	End   time.Time
+}
+
+func spanPeriods(spans []models.Span) []period {
+	periods := make([]period, len(spans))
+	for i, span := range spans {
+		periods[i] = period{span.Start, span.End}
+	}
+	return periods
+}
+
+// filterIdles splits the usage of each device into active and idle spans, each sorted by start.
+// The end of each span is adjusted to when it ended at view time, see common.SpanEnd.
+func filterIdles(usages []models.HourlyUsage) (map[string][]models.Span, map[string][]models.Span) {
+	// Hostnames belonging to the same device are treated as one continuous stream of spans.
+	spansByDevice := make(map[string][]models.Span)
 	for _, hourlyUsage := range usages {
-		for _, usage := range hourlyUsage.Events {
-			usageByHostname[usage.Hostname] = append(usageByHostname[usage.Hostname], usage)
+		for _, span := range common.HourlySpans(hourlyUsage) {
+			device := common.Device(span.Hostname)
+			spansByDevice[device] = append(spansByDevice[device], span)
 		}
 	}
 
-	timestampByHostname := make(map[string][]int64)
-	for hostname, usages := range usageByHostname {
-		sort.Sort(common.ByAt(usages))
+	activeByDevice := make(map[string][]models.Span)
+	idleByDevice := make(map[string][]models.Span)
+	for device, spans := range spansByDevice {
+		sort.Sort(common.ByStart(spans))
 
-		var events []models.Usage
-		// Simulating a deque by keeping an index to which elements from the beginning we've already
-		// processed.
-		i := 0
-		for _, usage := range usages {
-			events = append(events, usage)
+		var active, idle []models.Span
+		for i, span := range spans {
+			var next *models.Span
+			if i+1 < len(spans) {
+				next = &spans[i+1]
+			}
+			span.End = common.SpanEnd(span, next)
+			if !span.End.After(span.Start) {
+				continue
+			}
 
-			if usage.LastActivity < common.IdleTimeout {
-				for usage.At.Sub(events[i].At) > common.IdleTimeout {
-					logger.AddUsage(events[i])
-					timestampByHostname[hostname] = append(timestampByHostname[hostname], events[i].At.Unix())
-					i++
+			since, isIdle := common.Idle.IdleSince(span)
+			if !isIdle {
+				active = append(active, span)
+				continue
+			}
+			// There was no input since then, so everything after it was idle, including the end
+			// of earlier spans.
+			for len(active) > 0 && active[len(active)-1].End.After(since) {
+				last := &active[len(active)-1]
+				if last.Start.Before(since) {
+					idlePart := *last
+					idlePart.Start = since
+					idle = append(idle, idlePart)
+					last.End = since
+					break
 				}
-			} else {
-				events = []models.Usage{}
-				i = 0
+				idle = append(idle, *last)
+				active = active[:len(active)-1]
+			}
+			if span.Start.Before(since) {
+				activePart := span
+				activePart.End = since
+				active = append(active, activePart)
+				span.Start = since
 			}
+			idle = append(idle, span)
+		}
+
+		if len(active) > 0 {
+			activeByDevice[device] = active
+		}
+		if len(idle) > 0 {
+			sort.Sort(common.ByStart(idle))
+			idleByDevice[device] = idle
+		}
+	}
+
+	return activeByDevice, idleByDevice
+}
+
+// devicePriority returns the order in which devices win when they were in use at the same time:
+// the preferred device, then common.DevicePriority, then all other devices alphabetically.
+func devicePriority(preferred string, spansByDevice map[string][]models.Span) []string {
+	var priority []string
+	seen := make(map[string]bool)
+	for _, device := range append([]string{preferred}, common.DevicePriority...) {
+		if _, ok := spansByDevice[device]; ok && !seen[device] {
+			priority = append(priority, device)
+			seen[device] = true
 		}
-		for _, event := range events {
-			logger.AddUsage(event)
-			timestampByHostname[hostname] = append(timestampByHostname[hostname], event.At.Unix())
+	}
+	var rest []string
+	for device := range spansByDevice {
+		if !seen[device] {
+			rest = append(rest, device)
 		}
 	}
+	sort.Strings(rest)
+	return append(priority, rest...)
+}
 
-	return logger, timestampByHostname, nil
+// addDayUsage adds the annotations of day to logger, followed by the spans of all devices with
+// addUsage, except for what was annotated, and with meetings taking precedence. It returns the
+// annotated periods.
+func addDayUsage(logger usage.Logger, day time.Time, spansByDevice map[string][]models.Span, priority []string, meetings []models.Meeting, annotations []models.Annotation) []period {
+	var annotated []period
+	for _, annotation := range annotations {
+		span := annotationSpan(annotation)
+		span.Start, span.End = clampTime(span.Start, day, day.Add(time.Hour*24)), clampTime(span.End, day, day.Add(time.Hour*24))
+		logger.AddSpan(span)
+		annotated = append(annotated, period{span.Start, span.End})
+	}
+	annotated = mergePeriods(annotated)
+	usageLogger := &meetingLogger{
+		Logger:   &annotationLogger{Logger: logger, annotated: annotated},
+		meetings: meetings,
+	}
+	addUsage(usageLogger, spansByDevice, priority)
+	return annotated
 }
 
-func calculateIntervals(day time.Time, timestampByHostname map[string][]int64) ([]map[string]interface{}, time.Duration) {
+// addUsage adds the spans of all devices to logger. While several devices were in use at the same
+// time only the one that comes first in priority is counted, so the tree adds up to wall clock time.
+func addUsage(logger usage.Logger, spansByDevice map[string][]models.Span, priority []string) {
+	var claimed []period
+	for _, device := range priority {
+		spans := spansByDevice[device]
+		for _, span := range spans {
+			for _, p := range subtract(period{span.Start, span.End}, claimed) {
+				span.Start, span.End = p.Start, p.End
+				logger.AddSpan(span)
+			}
+		}
+		claimed = mergePeriods(append(claimed, spanPeriods(spans)...))
+	}
+}
+
+// calculateIntervals returns the timeline intervals of every device, the sum of the time each
+// device was in use and the wall clock time during which any device was in use.
+func calculateIntervals(day time.Time, periodsByDevice map[string][]period) ([]map[string]interface{}, time.Duration, time.Duration) {
 	// Make sure graph starts and ends at midnight by adding a pseudo-interval at the
 	// beginning and end.
 	allIntervals := []map[string]interface{}{
@@ -166,34 +397,132 @@ func calculateIntervals(day time.Time, timestampByHostname map[string][]int64) (
 		},
 	}
 	var total time.Duration
-	for hostname, timestamps := range timestampByHostname {
-		sort.Sort(int64Slice(timestamps))
+	var allPeriods []period
+	for device, periods := range periodsByDevice {
+		allPeriods = append(allPeriods, periods...)
 		var intervals []map[string]int64
-		last_ts := timestamps[0]
-		interval_start := last_ts
-		for _, timestamp := range timestamps {
-			if timestamp > last_ts+int64(common.LogInterval.Seconds()*2)-1 {
-				intervals = append(intervals, map[string]int64{
-					"starting_time": interval_start * 1000,
-					"ending_time":   last_ts * 1000,
-				})
-				total += time.Duration(last_ts-interval_start) * time.Second
-				interval_start = timestamp
-			}
-			last_ts = timestamp
+		for _, p := range mergePeriods(periods) {
+			intervals = append(intervals, map[string]int64{
+				"starting_time": p.Start.Unix() * 1000,
+				"ending_time":   p.End.Unix() * 1000,
+			})
+			total += p.End.Sub(p.Start)
 		}
-		intervals = append(intervals, map[string]int64{
-			"starting_time": interval_start * 1000,
-			"ending_time":   last_ts * 1000,
-		})
-		total += time.Duration(last_ts-interval_start) * time.Second
 		allIntervals = append(allIntervals, map[string]interface{}{
-			"label": hostname,
+			"label": device,
 			"times": intervals,
 		})
 	}
 
-	return allIntervals, total
+	var wallClock time.Duration
+	for _, p := range mergePeriods(allPeriods) {
+		wallClock += p.End.Sub(p.Start)
+	}
+
+	return allIntervals, total, wallClock
+}
+
+// mergePeriods sorts periods and joins the ones that touch or overlap.
+func mergePeriods(periods []period) []period {
+	sort.Sort(byStart(periods))
+	var merged []period
+	for _, p := range periods {
+		if len(merged) > 0 && !p.Start.After(merged[len(merged)-1].End) {
+			if p.End.After(merged[len(merged)-1].End) {
+				merged[len(merged)-1].End = p.End
+			}
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// subtract returns the parts of p that aren't covered by any of periods, which must be sorted and
+// must not overlap each other.
+func subtract(p period, periods []period) []period {
+	var parts []period
+	for _, c := range periods {
+		if !c.End.After(p.Start) {
+			continue
+		}
+		if !c.Start.Before(p.End) {
+			break
+		}
+		if c.Start.After(p.Start) {
+			parts = append(parts, period{p.Start, c.Start})
+		}
+		p.Start = c.End
+		if !p.Start.Before(p.End) {
+			return parts
+		}
+	}
+	return append(parts, p)
+}
+
+// queryUsage returns all usage logged in [from, to).
+func queryUsage(c appengine.Context, from, to time.Time) ([]models.HourlyUsage, error) {
+	q := datastore.NewQuery("HourlyUsage").
+		Filter("At >=", from).
+		Filter("At <", to).
+		Order("At")
+	var usages []models.HourlyUsage
+	_, err := q.GetAll(c, &usages)
+	return usages, err
+}
+
+// queryPieces returns all piano pieces started in [from, to).
+func queryPieces(c appengine.Context, from, to time.Time) ([]models.Piece, error) {
+	q := datastore.NewQuery("Piece").
+		Filter("Start >=", from).
+		Filter("Start <", to).
+		Order("Start")
+	var pieces []models.Piece
+	_, err := q.GetAll(c, &pieces)
+	return pieces, err
+}
+
+// parseDateRange parses the from and to form values into the start and end of a range of time.
+// Both are either dates, in which case the range starts at the beginning of from and ends at the end
+// of to, or times as sent by datetime-local inputs. Without from, the range covers the given number
+// of days up to and including to, which defaults to today.
+func parseDateRange(r *http.Request, loc *time.Location, days int) (time.Time, time.Time, error) {
+	to := BeginningOfDay(time.Now().In(loc)).AddDate(0, 0, 1)
+	if r.FormValue("to") != "" {
+		t, isDate, err := parseDateOrTime(r.FormValue("to"), loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Failed to parse to: %v", err)
+		}
+		to = t
+		if isDate {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+	from := BeginningOfDay(to.Add(-time.Nanosecond)).AddDate(0, 0, 1-days)
+	if r.FormValue("from") != "" {
+		t, _, err := parseDateOrTime(r.FormValue("from"), loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Failed to parse from: %v", err)
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("Range from %s to %s is empty", from, to)
+	}
+	return from, to, nil
+}
+
+func parseDateOrTime(value string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02T15:04", value, loc); err == nil {
+		return t, false, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, loc)
+	return t, true, err
+}
+
+// location returns the timezone in which days start and end.
+func location() (*time.Location, error) {
+	return time.LoadLocation("Europe/London")
 }
 
 func BeginningOfHour(t time.Time) time.Time {
@@ -205,8 +534,8 @@ func BeginningOfDay(t time.Time) time.Time {
 	return BeginningOfHour(t).Add(d)
 }
 
-type int64Slice []int64
+type byStart []period
 
-func (a int64Slice) Len() int           { return len(a) }
-func (a int64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a int64Slice) Less(i, j int) bool { return a[i] < a[j] }
+func (a byStart) Len() int           { return len(a) }
+func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStart) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
@@ -0,0 +1,109 @@
+package usage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"common"
+	"importer"
+	"models"
+)
+
+func init() {
+	http.HandleFunc("/admin/import/", importHandler)
+}
+
+// importHandler imports the history of other time trackers. The export is either uploaded as the
+// "file" field of a form or sent as the request body, and source names the tracker it came from.
+// With source=ics, it imports meetings from an iCalendar file instead, which can also be fetched
+// from url. With source=gitlog, it imports the commits of the repository named repo from a git log
+// exported with importer.GitLogFormat.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		http.Error(w, "Importing requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		body = file
+	}
+
+	if r.FormValue("source") == "ics" {
+		var count int
+		var err error
+		if r.FormValue("url") != "" {
+			count, err = importCalendarURL(c, r.FormValue("url"), r.FormValue("calendar"))
+		} else {
+			count, err = importCalendar(c, body, r.FormValue("calendar"))
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to import calendar: %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "Imported %d meetings\n", count)
+		return
+	}
+
+	if r.FormValue("source") == "gitlog" {
+		if r.FormValue("repo") == "" {
+			http.Error(w, "Missing repo", http.StatusBadRequest)
+			return
+		}
+		commits, err := importer.GitLog(body, r.FormValue("repo"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to import git log: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := importCommits(c, commits); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "Imported %d commits\n", len(commits))
+		return
+	}
+
+	var events []models.Usage
+	var err error
+	switch r.FormValue("source") {
+	case "rescuetime":
+		hostname := r.FormValue("host")
+		if hostname == "" {
+			hostname = "rescuetime"
+		}
+		var loc *time.Location
+		loc, err = location()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+			return
+		}
+		events, err = importer.RescueTime(body, hostname, loc)
+	case "activitywatch":
+		events, err = importer.ActivityWatch(body)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown source %q", r.FormValue("source")), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to import %s: %v", r.FormValue("source"), err), http.StatusBadRequest)
+		return
+	}
+
+	spansByHour := make(map[time.Time][]models.Span)
+	for _, event := range events {
+		hour := event.At.Truncate(time.Hour)
+		spansByHour[hour] = append(spansByHour[hour], common.SampleSpan(event))
+	}
+	if _, err := storeHours(c, spansByHour); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to apply transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Imported %d events in %d hours\n", len(events), len(spansByHour))
+}
@@ -0,0 +1,105 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"common"
+	"models"
+)
+
+// awAFKTimeout is how long ActivityWatch waits without input before it considers the user AFK.
+const awAFKTimeout = 3 * time.Minute
+
+type awExport struct {
+	Buckets map[string]awBucket `json:"buckets"`
+}
+
+type awBucket struct {
+	Type     string    `json:"type"`
+	Hostname string    `json:"hostname"`
+	Events   []awEvent `json:"events"`
+}
+
+type awEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Duration  float64   `json:"duration"` // In seconds
+	Data      struct {
+		App    string `json:"app"`
+		Title  string `json:"title"`
+		Status string `json:"status"`
+	} `json:"data"`
+}
+
+func (e awEvent) end() time.Time {
+	return e.Timestamp.Add(time.Duration(e.Duration * float64(time.Second)))
+}
+
+// ActivityWatch converts an ActivityWatch bucket export into usage events. Window events become
+// samples of the focused app, and samples taken while the AFK watcher of the same host reported the
+// user as away are marked as idle.
+func ActivityWatch(r io.Reader) ([]models.Usage, error) {
+	var export awExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, fmt.Errorf("Failed to parse ActivityWatch export: %v", err)
+	}
+
+	afkByHostname := make(map[string][]awEvent)
+	for _, bucket := range export.Buckets {
+		if bucket.Type != "afkstatus" {
+			continue
+		}
+		for _, event := range bucket.Events {
+			if event.Data.Status == "afk" {
+				afkByHostname[bucket.Hostname] = append(afkByHostname[bucket.Hostname], event)
+			}
+		}
+	}
+	for _, afk := range afkByHostname {
+		sort.Sort(byTimestamp(afk))
+	}
+
+	var events []models.Usage
+	for _, bucket := range export.Buckets {
+		if bucket.Type != "currentwindow" {
+			continue
+		}
+		hostname := bucket.Hostname
+		if hostname == "" {
+			hostname = "unknown"
+		}
+		afk := afkByHostname[bucket.Hostname]
+		for _, event := range bucket.Events {
+			usage := models.Usage{
+				Focused:  models.App{Process: event.Data.App, WindowTitle: event.Data.Title},
+				Hostname: hostname,
+			}
+			for _, sample := range samples(usage, event.Timestamp, event.end().Sub(event.Timestamp)) {
+				sample.LastActivity = awLastActivity(sample.At, afk)
+				events = append(events, sample)
+			}
+		}
+	}
+	sort.Sort(common.ByAt(events))
+	return events, nil
+}
+
+// awLastActivity estimates how long before t the last input happened, given the periods during
+// which the user was AFK sorted by start.
+func awLastActivity(t time.Time, afk []awEvent) time.Duration {
+	// Find the last period starting no later than t.
+	i := sort.Search(len(afk), func(i int) bool { return afk[i].Timestamp.After(t) }) - 1
+	if i >= 0 && t.Before(afk[i].end()) {
+		return t.Sub(afk[i].Timestamp) + awAFKTimeout
+	}
+	return 0
+}
+
+type byTimestamp []awEvent
+
+func (a byTimestamp) Len() int           { return len(a) }
+func (a byTimestamp) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTimestamp) Less(i, j int) bool { return a[i].Timestamp.Before(a[j].Timestamp) }
@@ -0,0 +1,50 @@
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"models"
+)
+
+// GitLogFormat is the format GitLog expects the log to be exported in, e.g. with
+// git log --pretty=format:'%H%x09%at%x09%an%x09%s'
+const GitLogFormat = "%H%x09%at%x09%an%x09%s"
+
+// GitLog converts a git log exported with GitLogFormat into commits of the given repository.
+func GitLog(r io.Reader, repo string) ([]models.Commit, error) {
+	var commits []models.Commit
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		fields := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Line %d has %d fields, expected at least 3", line, len(fields))
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse time in line %d: %v", line, err)
+		}
+		commit := models.Commit{
+			Repo:   repo,
+			Hash:   fields[0],
+			Time:   time.Unix(seconds, 0),
+			Author: fields[2],
+		}
+		if len(fields) == 4 {
+			commit.Subject = fields[3]
+		}
+		commits = append(commits, commit)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read log: %v", err)
+	}
+	return commits, nil
+}
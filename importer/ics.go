@@ -0,0 +1,384 @@
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"models"
+)
+
+// maxOccurrences limits how many occurrences of a single recurring event are imported from the
+// window passed to ICS.
+const maxOccurrences = 1000
+
+// ICS converts the events of an iCalendar file into meetings, skipping the ones that start before
+// since. Recurring events are expanded up to until, but only daily and weekly recurrences are
+// supported; other ones only import their first occurrence. All-day and cancelled events aren't
+// meetings and are skipped. Times without time zone are in loc.
+func ICS(r io.Reader, loc *time.Location, since, until time.Time) ([]models.Meeting, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read calendar: %v", err)
+	}
+
+	var calendar string
+	var events []*icsEvent
+	var components []string
+	var event *icsEvent
+	for i, line := range lines {
+		name, params, value, err := parseContentLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", i+1, err)
+		}
+		switch name {
+		case "BEGIN":
+			components = append(components, value)
+			if value == "VEVENT" && len(components) == 2 {
+				event = &icsEvent{}
+			}
+			continue
+		case "END":
+			if len(components) == 0 || components[len(components)-1] != value {
+				return nil, fmt.Errorf("Line %d: unexpected END:%s", i+1, value)
+			}
+			components = components[:len(components)-1]
+			if value == "VEVENT" && event != nil {
+				events = append(events, event)
+				event = nil
+			}
+			continue
+		}
+
+		if len(components) == 1 && name == "X-WR-CALNAME" {
+			calendar = unescape(value)
+		}
+		if event == nil || len(components) != 2 {
+			// Properties of the calendar, time zones or alarms.
+			continue
+		}
+		if err := event.set(name, params, value, loc); err != nil {
+			return nil, fmt.Errorf("Line %d: %v", i+1, err)
+		}
+	}
+
+	// Modified occurrences of recurring events replace the occurrence they were generated as.
+	overridden := make(map[string]bool)
+	for _, e := range events {
+		if !e.recurrenceID.IsZero() {
+			overridden[occurrenceKey(e.uid, e.recurrenceID)] = true
+		}
+	}
+
+	var meetings []models.Meeting
+	for _, e := range events {
+		if e.allDay || e.start.IsZero() || e.status == "CANCELLED" {
+			continue
+		}
+		if e.end.IsZero() {
+			e.end = e.start.Add(e.duration)
+		}
+		starts := []time.Time{e.start}
+		if e.rrule != "" && e.recurrenceID.IsZero() {
+			starts, err = e.occurrences(loc, since, until)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to expand %q: %v", e.summary, err)
+			}
+		}
+		for _, start := range starts {
+			if start.Before(since) {
+				continue
+			}
+			if e.recurrenceID.IsZero() && overridden[occurrenceKey(e.uid, start)] {
+				continue
+			}
+			meetings = append(meetings, models.Meeting{
+				Start:    start,
+				End:      start.Add(e.end.Sub(e.start)),
+				Summary:  e.summary,
+				UID:      e.uid,
+				Calendar: calendar,
+			})
+		}
+	}
+	sort.Sort(byMeetingStart(meetings))
+	return meetings, nil
+}
+
+type icsEvent struct {
+	uid          string
+	summary      string
+	status       string
+	start        time.Time
+	end          time.Time
+	duration     time.Duration
+	allDay       bool
+	rrule        string
+	exdates      []time.Time
+	recurrenceID time.Time
+}
+
+func (e *icsEvent) set(name string, params map[string]string, value string, loc *time.Location) error {
+	var err error
+	switch name {
+	case "UID":
+		e.uid = value
+	case "SUMMARY":
+		e.summary = unescape(value)
+	case "STATUS":
+		e.status = strings.ToUpper(value)
+	case "DTSTART":
+		e.start, e.allDay, err = parseICSTime(value, params, loc)
+	case "DTEND":
+		e.end, _, err = parseICSTime(value, params, loc)
+	case "DURATION":
+		e.duration, err = parseICSDuration(value)
+	case "RRULE":
+		e.rrule = value
+	case "EXDATE":
+		for _, v := range strings.Split(value, ",") {
+			t, _, err := parseICSTime(v, params, loc)
+			if err != nil {
+				return err
+			}
+			e.exdates = append(e.exdates, t)
+		}
+	case "RECURRENCE-ID":
+		e.recurrenceID, _, err = parseICSTime(value, params, loc)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", name, err)
+	}
+	return nil
+}
+
+// occurrences returns the starts of the occurrences of a recurring event from since until the end
+// of its recurrence or until, whichever is first. Occurrences before since aren't returned, but
+// still count towards the COUNT of the rule.
+func (e *icsEvent) occurrences(loc *time.Location, since, until time.Time) ([]time.Time, error) {
+	rule := make(map[string]string)
+	for _, part := range strings.Split(e.rrule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			rule[strings.ToUpper(kv[0])] = kv[1]
+		}
+	}
+
+	interval := 1
+	if rule["INTERVAL"] != "" {
+		i, err := strconv.Atoi(rule["INTERVAL"])
+		if err != nil || i < 1 {
+			return nil, fmt.Errorf("Invalid INTERVAL %q", rule["INTERVAL"])
+		}
+		interval = i
+	}
+	count := -1 // Unlimited
+	if rule["COUNT"] != "" {
+		c, err := strconv.Atoi(rule["COUNT"])
+		if err != nil || c < 1 {
+			return nil, fmt.Errorf("Invalid COUNT %q", rule["COUNT"])
+		}
+		count = c
+	}
+	if rule["UNTIL"] != "" {
+		t, allDay, err := parseICSTime(rule["UNTIL"], nil, loc)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid UNTIL: %v", err)
+		}
+		if allDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		if t.Before(until) {
+			until = t
+		}
+	}
+
+	// Candidate days relative to the start of each period, in order.
+	var step func(t time.Time, n int) time.Time
+	offsets := []int{0}
+	periodStart := e.start
+	switch strings.ToUpper(rule["FREQ"]) {
+	case "DAILY":
+		step = func(t time.Time, n int) time.Time { return t.AddDate(0, 0, n) }
+	case "WEEKLY":
+		step = func(t time.Time, n int) time.Time { return t.AddDate(0, 0, 7*n) }
+		// Weeks start on Monday.
+		periodStart = e.start.AddDate(0, 0, -((int(e.start.Weekday()) + 6) % 7))
+		if rule["BYDAY"] != "" {
+			offsets = nil
+			for _, day := range strings.Split(rule["BYDAY"], ",") {
+				offset, ok := weekdayOffsets[strings.ToUpper(day)]
+				if !ok {
+					// E.g. "1MO" only makes sense for monthly recurrences.
+					return []time.Time{e.start}, nil
+				}
+				offsets = append(offsets, offset)
+			}
+			sort.Ints(offsets)
+		} else {
+			offsets = []int{(int(e.start.Weekday()) + 6) % 7}
+		}
+	default:
+		return []time.Time{e.start}, nil
+	}
+
+	// seen counts all occurrences from the start for COUNT, including excluded ones.
+	var starts []time.Time
+	seen := 0
+	done := func() bool { return (count >= 0 && seen >= count) || len(starts) >= maxOccurrences }
+	for period := 0; !done(); period += interval {
+		base := step(periodStart, period)
+		if base.After(until) {
+			break
+		}
+		for _, offset := range offsets {
+			start := base.AddDate(0, 0, offset)
+			if start.Before(e.start) {
+				continue
+			}
+			if start.After(until) || done() {
+				break
+			}
+			seen++
+			if !start.Before(since) && !containsTime(e.exdates, start) {
+				starts = append(starts, start)
+			}
+		}
+	}
+	return starts, nil
+}
+
+var weekdayOffsets = map[string]int{"MO": 0, "TU": 1, "WE": 2, "TH": 3, "FR": 4, "SA": 5, "SU": 6}
+
+// unfold reads the content lines of a calendar, joining lines that were folded onto several.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// parseContentLine splits a line like "DTSTART;TZID=Europe/London:20150102T100000" into its name,
+// parameters and value.
+func parseContentLine(line string) (string, map[string]string, string, error) {
+	quoted := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, "", fmt.Errorf("Missing value in %q", line)
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	params := make(map[string]string)
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, line[colon+1:], nil
+}
+
+// parseICSTime parses a date or date-time value and returns whether it was a date.
+func parseICSTime(value string, params map[string]string, loc *time.Location) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	if tzid := params["TZID"]; tzid != "" {
+		// Calendars from Windows use names like "GMT Standard Time" that Go doesn't know, those
+		// fall back to loc.
+		if tz, err := time.LoadLocation(tzid); err == nil {
+			loc = tz
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// parseICSDuration parses durations like "PT1H30M" or "P1D".
+func parseICSDuration(value string) (time.Duration, error) {
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+	}
+	value = strings.TrimLeft(value, "+-")
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("Invalid duration %q", value)
+	}
+
+	units := map[byte]time.Duration{
+		'W': 7 * 24 * time.Hour,
+		'D': 24 * time.Hour,
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+	}
+	var d time.Duration
+	number := ""
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 'T':
+		case c >= '0' && c <= '9':
+			number += string(c)
+		default:
+			unit, ok := units[c]
+			n, err := strconv.Atoi(number)
+			if !ok || err != nil {
+				return 0, fmt.Errorf("Invalid duration %q", value)
+			}
+			d += time.Duration(n) * unit
+			number = ""
+		}
+	}
+	return sign * d, nil
+}
+
+func unescape(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+func occurrenceKey(uid string, start time.Time) string {
+	return fmt.Sprintf("%s/%d", uid, start.Unix())
+}
+
+func containsTime(times []time.Time, t time.Time) bool {
+	for _, other := range times {
+		if other.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+type byMeetingStart []models.Meeting
+
+func (a byMeetingStart) Len() int           { return len(a) }
+func (a byMeetingStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMeetingStart) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
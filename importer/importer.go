@@ -0,0 +1,24 @@
+package importer
+
+import (
+	"time"
+
+	"common"
+	"models"
+)
+
+// samples spreads usage over length by repeating it every common.LogInterval from start, just like
+// a client sampling the focused window would have.
+func samples(usage models.Usage, start time.Time, length time.Duration) []models.Usage {
+	var events []models.Usage
+	for offset := time.Duration(0); offset < length; offset += common.LogInterval {
+		event := usage
+		event.At = start.Add(offset)
+		event.Interval = common.LogInterval
+		if remaining := length - offset; remaining < common.LogInterval {
+			event.Interval = remaining
+		}
+		events = append(events, event)
+	}
+	return events
+}
@@ -0,0 +1,95 @@
+package importer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"models"
+)
+
+// RescueTime converts a RescueTime CSV export with hourly resolution into usage events for the
+// given hostname. RescueTime only records how much time was spent on each activity per hour, so
+// the activities of an hour are laid out one after the other from the start of the hour.
+func RescueTime(r io.Reader, hostname string, loc *time.Location) ([]models.Usage, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("Empty CSV")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, name := range []string{"Date", "Time Spent (seconds)", "Activity"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("Missing column %q", name)
+		}
+	}
+
+	type activity struct {
+		name     string
+		document string
+		spent    time.Duration
+	}
+	activitiesByHour := make(map[time.Time][]activity)
+	for i, row := range records[1:] {
+		if len(row) != len(records[0]) {
+			return nil, fmt.Errorf("Row %d has %d columns, expected %d", i+2, len(row), len(records[0]))
+		}
+		hour, err := time.ParseInLocation("2006-01-02T15:04:05", row[columns["Date"]], loc)
+		if err != nil {
+			hour, err = time.ParseInLocation("2006-01-02 15:04:05", row[columns["Date"]], loc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse date in row %d: %v", i+2, err)
+		}
+		seconds, err := strconv.Atoi(row[columns["Time Spent (seconds)"]])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse time spent in row %d: %v", i+2, err)
+		}
+		a := activity{
+			name:  row[columns["Activity"]],
+			spent: time.Duration(seconds) * time.Second,
+		}
+		if i, ok := columns["Document"]; ok {
+			a.document = row[i]
+		}
+		activitiesByHour[hour] = append(activitiesByHour[hour], a)
+	}
+
+	var hours []time.Time
+	for hour := range activitiesByHour {
+		hours = append(hours, hour)
+	}
+	sort.Sort(byTime(hours))
+
+	var events []models.Usage
+	for _, hour := range hours {
+		start := hour
+		for _, a := range activitiesByHour[hour] {
+			title := a.document
+			if title == "" || title == "No Details" {
+				title = a.name
+			}
+			events = append(events, samples(models.Usage{
+				Focused:  models.App{Process: a.name, WindowTitle: title},
+				Hostname: hostname,
+			}, start, a.spent)...)
+			start = start.Add(a.spent)
+		}
+	}
+	return events, nil
+}
+
+type byTime []time.Time
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTime) Less(i, j int) bool { return a[i].Before(a[j]) }
@@ -1,33 +1,218 @@
 package usage
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"appengine"
-	"appengine/datastore"
 
 	"common"
 	"models"
+	"usage"
 )
 
+const listPageSize = 100
+
+// listMaxRange is the longest range the event browser loads at once, since all of its spans are
+// loaded to sort and count them.
+const listMaxRange = 7 * 24 * time.Hour
+
+var listTemplate = template.Must(template.ParseFiles("templates/list.html"))
+
+// RawEvent is a single stored span as shown by the raw event browser.
+type RawEvent struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Hostname string    `json:"hostname"`
+	Process  string    `json:"process"`
+	Title    string    `json:"title"`
+	Idle     int64     `json:"idle_ms"` // Time since the last activity at the last sample
+	Category string    `json:"category"`
+}
+
 func listHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
-	q := datastore.NewQuery("HourlyUsage").Order("-At").Limit(2)
-	var usages []models.HourlyUsage
-	_, err := q.GetAll(c, &usages)
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := parseDateRange(r, loc, 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > listMaxRange {
+		http.Error(w, fmt.Sprintf("Range from %s to %s is longer than %v", from, to, listMaxRange), http.StatusBadRequest)
+		return
+	}
+	page := 0
+	if r.FormValue("page") != "" {
+		page, err = strconv.Atoi(r.FormValue("page"))
+		if err != nil || page < 0 {
+			http.Error(w, fmt.Sprintf("Invalid page %q", r.FormValue("page")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	usages, err := queryUsage(c, from.Truncate(time.Hour), to)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to query usage logs: %v", err), http.StatusInternalServerError)
 		return
 	}
+	rules, err := requestRules(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger, err := usage.MakeLogger(rules.Rules, usage.DefaultEditorDepth)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create logger: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	hostname := r.FormValue("host")
+	hostnames := make(map[string]bool)
+	var spans []models.Span
+	for _, hourlyUsage := range usages {
+		for _, span := range common.HourlySpans(hourlyUsage) {
+			hostnames[span.Hostname] = true
+			if !span.End.After(from) || !span.Start.Before(to) {
+				continue
+			}
+			if hostname == "" || span.Hostname == hostname {
+				spans = append(spans, span)
+			}
+		}
+	}
+	sort.Sort(common.ByStart(spans))
+
+	rawEvents := make([]RawEvent, len(spans))
+	for i, span := range spans {
+		rawEvents[i] = RawEvent{
+			Start:    span.Start.In(loc),
+			End:      span.End.In(loc),
+			Hostname: span.Hostname,
+			Process:  span.Focused.Process,
+			Title:    span.Focused.WindowTitle,
+			Idle:     int64(span.LastActivity / time.Millisecond),
+		}
+	}
+	// Categorizing is the expensive part, so only do it for the events that are shown.
+	categorize := func(start, end int) {
+		for i := start; i < end; i++ {
+			rawEvents[i].Category = strings.Join(logger.Category(spans[i]), "/")
+		}
+	}
+
+	switch r.FormValue("format") {
+	case "json":
+		categorize(0, len(rawEvents))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=events.json")
+		if err := json.NewEncoder(w).Encode(rawEvents); err != nil {
+			c.Errorf("Failed to write events: %v", err)
+		}
+		return
+	case "csv":
+		categorize(0, len(rawEvents))
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=events.csv")
+		if err := writeRawEventsCSV(w, rawEvents); err != nil {
+			c.Errorf("Failed to write events: %v", err)
+		}
+		return
+	case "":
+	default:
+		http.Error(w, fmt.Sprintf("Unknown format %q", r.FormValue("format")), http.StatusBadRequest)
+		return
+	}
 
-	for _, usage := range usages {
-		fmt.Fprintf(w, "\n\n\n%s", usage.At)
-		sort.Sort(common.ByAt(usage.Events))
-		for _, event := range usage.Events {
-			fmt.Fprintf(w, "%s\n", event)
+	var allHostnames []string
+	for h := range hostnames {
+		allHostnames = append(allHostnames, h)
+	}
+	sort.Strings(allHostnames)
+
+	start := page * listPageSize
+	if start > len(rawEvents) {
+		start = len(rawEvents)
+	}
+	end := start + listPageSize
+	if end > len(rawEvents) {
+		end = len(rawEvents)
+	}
+	categorize(start, end)
+
+	// Keep all filters, like the rules version, when paging or downloading.
+	query := url.Values{}
+	for k, v := range r.Form {
+		if k != "page" && k != "format" {
+			query[k] = v
+		}
+	}
+	query.Set("from", from.In(loc).Format("2006-01-02T15:04"))
+	query.Set("to", to.In(loc).Format("2006-01-02T15:04"))
+	query.Set("host", hostname)
+	pageURL := func(values map[string]string) string {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		for k, v := range values {
+			q.Set(k, v)
 		}
+		return "/list/?" + q.Encode()
+	}
+
+	data := make(map[string]interface{})
+	data["From"] = from.In(loc).Format("2006-01-02T15:04")
+	data["To"] = to.In(loc).Format("2006-01-02T15:04")
+	data["Host"] = hostname
+	data["Hostnames"] = allHostnames
+	data["Events"] = rawEvents[start:end]
+	data["Count"] = len(rawEvents)
+	data["First"] = start + 1
+	data["Last"] = end
+	if page > 0 {
+		data["PrevURL"] = pageURL(map[string]string{"page": strconv.Itoa(page - 1)})
+	}
+	if end < len(rawEvents) {
+		data["NextURL"] = pageURL(map[string]string{"page": strconv.Itoa(page + 1)})
+	}
+	data["JSONURL"] = pageURL(map[string]string{"format": "json"})
+	data["CSVURL"] = pageURL(map[string]string{"format": "csv"})
+
+	if err := listTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func writeRawEventsCSV(w io.Writer, events []RawEvent) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"start", "end", "hostname", "process", "title", "idle_ms", "category"})
+	for _, event := range events {
+		writer.Write([]string{
+			event.Start.Format(time.RFC3339),
+			event.End.Format(time.RFC3339),
+			event.Hostname,
+			event.Process,
+			event.Title,
+			strconv.FormatInt(event.Idle, 10),
+			event.Category,
+		})
 	}
+	writer.Flush()
+	return writer.Error()
 }
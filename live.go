@@ -0,0 +1,201 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"common"
+	"models"
+	"usage"
+)
+
+// How often /live/ checks for new usage, and for how long before it gives up and lets the browser
+// reconnect, which has to stay well below the request deadline.
+const (
+	liveCheckInterval = 2 * time.Second
+	liveTimeout       = 45 * time.Second
+)
+
+// silentAfter is how long a device has to stop logging before it's reported as silent.
+const silentAfter = 30 * time.Minute
+
+func init() {
+	http.HandleFunc("/live/", liveHandler)
+	http.HandleFunc("/cron/silent/", silentCronHandler)
+}
+
+// DeviceStatus is what a device is currently focused on.
+type DeviceStatus struct {
+	Device   string    `json:"device"`
+	Hostname string    `json:"hostname"`
+	Process  string    `json:"process"`
+	Title    string    `json:"title"`
+	Category string    `json:"category"`
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"last_seen"`
+	Idle     bool      `json:"idle"`
+	// Silent devices haven't logged anything for longer than their idle timeout.
+	Silent bool `json:"silent"`
+}
+
+type liveUpdate struct {
+	Devices []DeviceStatus `json:"devices"`
+}
+
+// liveHandler streams the current status of all devices as Server-Sent Events. The ID of each event
+// is the time of the newest sample it includes, so a browser reconnecting with Last-Event-ID only
+// gets an event once newer usage was logged. Since App Engine buffers responses, each request sends
+// at most one event and the browser reconnects for the next one.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	var lastID int64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		if lastID, err = strconv.ParseInt(id, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse Last-Event-ID: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	rules, err := loadRules(c, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger, err := usage.MakeLogger(rules.Rules, usage.DefaultEditorDepth)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create logger: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: %d\n\n", liveCheckInterval/time.Millisecond)
+
+	deadline := time.Now().Add(liveTimeout)
+	for {
+		usages, err := queryUsage(c, time.Now().Truncate(time.Hour).Add(-time.Hour), time.Now().Add(time.Hour))
+		if err != nil {
+			c.Errorf("Failed to query usage logs: %v", err)
+			return
+		}
+		statuses, newest := deviceStatuses(usages, logger, time.Now())
+		if newest.UnixNano() > lastID {
+			data, err := json.Marshal(liveUpdate{Devices: statuses})
+			if err != nil {
+				c.Errorf("Failed to marshal live update: %v", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", newest.UnixNano(), data)
+			return
+		}
+		if time.Now().Add(liveCheckInterval).After(deadline) {
+			return
+		}
+		time.Sleep(liveCheckInterval)
+	}
+}
+
+// silentCronHandler reports devices that logged during the last day but haven't done so for
+// silentAfter to webhooks, once each time they go silent.
+func silentCronHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !subscribed(eventDeviceSilent) {
+		return
+	}
+
+	now := time.Now()
+	usages, err := queryUsage(c, now.Truncate(time.Hour).Add(-24*time.Hour), now.Add(time.Hour))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query usage logs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rules, err := loadRules(c, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger, err := usage.MakeLogger(rules.Rules, usage.DefaultEditorDepth)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create logger: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	statuses, _ := deviceStatuses(usages, logger, now)
+	for _, status := range statuses {
+		if now.Sub(status.LastSeen) < silentAfter {
+			continue
+		}
+		key := datastore.NewKey(c, "SilentDevice", status.Device, 0, nil)
+		var silent models.SilentDevice
+		err := datastore.Get(c, key, &silent)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			http.Error(w, fmt.Sprintf("Failed to get silent device %s: %v", status.Device, err), http.StatusInternalServerError)
+			return
+		}
+		if silent.LastSeen.Equal(status.LastSeen) {
+			continue
+		}
+
+		if err := fireEvent(c, eventDeviceSilent, status); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		silent = models.SilentDevice{Device: status.Device, LastSeen: status.LastSeen}
+		if _, err := datastore.Put(c, key, &silent); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save silent device %s: %v", status.Device, err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// deviceStatuses returns the status of every device from its newest span, sorted by device, and
+// the time of the newest sample of all of them.
+func deviceStatuses(usages []models.HourlyUsage, logger usage.Logger, now time.Time) ([]DeviceStatus, time.Time) {
+	newestByDevice := make(map[string]models.Span)
+	for _, hourlyUsage := range usages {
+		for _, span := range common.HourlySpans(hourlyUsage) {
+			device := common.Device(span.Hostname)
+			if newest, ok := newestByDevice[device]; !ok || common.LastSample(span).After(common.LastSample(newest)) {
+				newestByDevice[device] = span
+			}
+		}
+	}
+
+	var statuses []DeviceStatus
+	var newest time.Time
+	for device, span := range newestByDevice {
+		lastSeen := common.LastSample(span)
+		if lastSeen.After(newest) {
+			newest = lastSeen
+		}
+		_, idle := common.Idle.IdleSince(span)
+		statuses = append(statuses, DeviceStatus{
+			Device:   device,
+			Hostname: span.Hostname,
+			Process:  span.Focused.Process,
+			Title:    span.Focused.WindowTitle,
+			Category: strings.Join(logger.Category(span), "/"),
+			Since:    span.Start,
+			LastSeen: lastSeen,
+			Idle:     idle,
+			Silent:   now.Sub(lastSeen) > common.Idle.HostTimeout(span.Hostname),
+		})
+	}
+	sort.Sort(byStatusDevice(statuses))
+	return statuses, newest
+}
+
+type byStatusDevice []DeviceStatus
+
+func (a byStatusDevice) Len() int           { return len(a) }
+func (a byStatusDevice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStatusDevice) Less(i, j int) bool { return a[i].Device < a[j].Device }
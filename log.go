@@ -1,14 +1,17 @@
 package usage
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
 	"appengine"
 	"appengine/datastore"
 
+	"common"
 	"models"
 )
 
@@ -18,6 +21,7 @@ type RawUsage struct {
 	Visible      []RawApp
 	LastActivity float64 `json:"last_activity_ms"`
 	Hostname     string
+	Interval     float64 `json:"interval_ms"`
 }
 
 type RawApp struct {
@@ -25,19 +29,113 @@ type RawApp struct {
 	Exec string
 }
 
+// Limits for events sent to /log/, beyond which they are rejected as implausible.
+const (
+	maxClockAhead   = 5 * time.Minute
+	maxEventAge     = 30 * 24 * time.Hour
+	maxLastActivity = 30 * 24 * time.Hour
+)
+
+// Limits for the size of requests to /log/, as sent and after decompressing them.
+const (
+	maxLogSize             = 8 << 20
+	maxLogDecompressedSize = 64 << 20
+)
+
+// LogResponse tells clients what happened to each event they sent to /log/. Rejected events are
+// invalid and must not be sent again, while the events of failed hours can safely be retried since
+// duplicates are ignored.
+type LogResponse struct {
+	Accepted     int             `json:"accepted"`
+	Deduplicated int             `json:"deduplicated"`
+	Rejected     []RejectedUsage `json:"rejected"`
+	// Number of rejected events per reason.
+	RejectedReasons map[string]int `json:"rejected_reasons"`
+	Failed          []FailedHour   `json:"failed"`
+}
+
+type RejectedUsage struct {
+	Index  int    `json:"index"` // Position of the event in the request, after expanding spans
+	Reason string `json:"reason"`
+}
+
+type FailedHour struct {
+	Hour    time.Time `json:"hour"`
+	Indices []int     `json:"indices"` // Positions of the events of this hour, like RejectedUsage.Index
+	Error   string    `json:"error"`
+}
+
 func logHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
+	c := appengine.NewContext(r)
+	now := time.Now()
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxLogSize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decompress request: %v", err), http.StatusBadRequest)
+			return
+		}
+		body = io.LimitReader(gz, maxLogDecompressedSize)
+	}
+	decoder := json.NewDecoder(body)
 
 	var usages []RawUsage
-	err := decoder.Decode(&usages)
+	var err error
+	if r.Header.Get("Content-Type") == spansContentType {
+		var spans RawSpans
+		if err = decoder.Decode(&spans); err == nil {
+			usages, err = spans.expand()
+		}
+	} else if err = decoder.Decode(&usages); err == nil && len(usages) > maxExpandedCount {
+		err = fmt.Errorf("More than %d samples", maxExpandedCount)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to unmarshal request: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	usageByHour := make(map[time.Time][]models.Usage)
+	for i := range usages {
+		if usages[i].Hostname == "" {
+			usages[i].Hostname = "unknown"
+		}
+	}
+	var hostnames []string
+	seen := make(map[string]bool)
 	for _, usage := range usages {
-		if len(usage.Focused) == 0 {
+		if !seen[usage.Hostname] {
+			hostnames = append(hostnames, usage.Hostname)
+			seen[usage.Hostname] = true
+		}
+	}
+	skew, measured, err := clientSkew(r, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clocks, err := updateClocks(c, hostnames, now, skew, measured)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Correct the time before validating, so that a host with a clock that's too far ahead can
+	// still log once its correction is enabled.
+	for i := range usages {
+		at := time.Unix(0, int64(usages[i].Time*1e9))
+		usages[i].Time = float64(correctTime(clocks[usages[i].Hostname], at).UnixNano()) / 1e9
+	}
+
+	response := LogResponse{RejectedReasons: make(map[string]int)}
+	reject := func(i int, reason string) {
+		response.Rejected = append(response.Rejected, RejectedUsage{Index: i, Reason: reason})
+		response.RejectedReasons[reason]++
+	}
+
+	usageByHour := make(map[time.Time][]models.Usage)
+	indicesByHour := make(map[time.Time][]int)
+	for i, usage := range usages {
+		if reason := validateUsage(usage, now); reason != "" {
+			reject(i, reason)
 			continue
 		}
 
@@ -53,56 +151,195 @@ func logHandler(w http.ResponseWriter, r *http.Request) {
 			})
 		}
 
-		hostname := usage.Hostname
-		if hostname == "" {
-			hostname = "unknown"
-		}
-
 		usageEvent := models.Usage{
 			At:           time.Unix(int64(usage.Time), 0),
 			Focused:      focused,
 			LastActivity: time.Duration(int64(usage.LastActivity)) * time.Millisecond,
-			Hostname:     hostname,
+			Hostname:     usage.Hostname,
+			Interval:     time.Duration(int64(usage.Interval)) * time.Millisecond,
 		}
 
-		// Only log hours with less than an hour of inactivity.
-		if usageEvent.LastActivity < time.Hour {
-			hour := usageEvent.At.Truncate(time.Hour)
-			usageByHour[hour] = append(usageByHour[hour], usageEvent)
+		// Drop events after long periods of inactivity, when the user clearly wasn't there.
+		if common.Idle.Inactive(focused.Process, usageEvent.LastActivity) {
+			reject(i, "inactive")
+			continue
 		}
+		hour := usageEvent.At.Truncate(time.Hour)
+		usageByHour[hour] = append(usageByHour[hour], usageEvent)
+		indicesByHour[hour] = append(indicesByHour[hour], i)
 	}
 
-	c := appengine.NewContext(r)
+	// Each hour is saved in its own transaction, so keep going when one of them fails and report
+	// exactly which events weren't saved.
+	var updated []time.Time
 	for hour, usage := range usageByHour {
-		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
-			key := datastore.NewKey(c, "HourlyUsage", "", hour.Unix(), nil)
-			storedUsage := models.HourlyUsage{}
-			err := datastore.Get(c, key, &storedUsage)
-			if err != nil {
-				storedUsage = models.HourlyUsage{
-					At: hour,
-				}
+		duplicates, err := storeUsage(c, hour, usage)
+		if err != nil {
+			c.Errorf("Failed to apply transaction for %s: %v", hour, err)
+			response.Failed = append(response.Failed, FailedHour{
+				Hour:    hour,
+				Indices: indicesByHour[hour],
+				Error:   err.Error(),
+			})
+			continue
+		}
+		response.Accepted += len(usage) - duplicates
+		response.Deduplicated += duplicates
+		if duplicates < len(usage) {
+			updated = append(updated, hour)
+		}
+	}
+	if err := queueBudgetChecks(c, updated); err != nil {
+		// The usage is saved, budgets will be checked the next time something is logged.
+		c.Errorf("%v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(response.Failed) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		c.Errorf("Failed to write response: %v", err)
+	}
+}
+
+// validateUsage returns why usage can't be logged, or an empty string if it's valid.
+func validateUsage(usage RawUsage, now time.Time) string {
+	at := time.Unix(int64(usage.Time), 0)
+	lastActivity := time.Duration(int64(usage.LastActivity)) * time.Millisecond
+	switch {
+	case len(usage.Focused) == 0:
+		return "no focused app"
+	case usage.Focused[0].Exec == "":
+		return "empty process"
+	case at.After(now.Add(maxClockAhead)):
+		return "in the future"
+	case at.Before(now.Add(-maxEventAge)):
+		return "too old"
+	case lastActivity < 0 || lastActivity > maxLastActivity:
+		return "invalid last activity"
+	case usage.Interval < 0:
+		return "invalid interval"
+	}
+	return ""
+}
+
+// storeUsage adds samples to the HourlyUsage entity of the given hour, see storeSpans.
+func storeUsage(c appengine.Context, hour time.Time, events []models.Usage) (int, error) {
+	spans := make([]models.Span, len(events))
+	for i, event := range events {
+		spans[i] = common.SampleSpan(event)
+	}
+	return storeSpans(c, hour, spans)
+}
+
+// storeSpans adds spans to the HourlyUsage entity of the given hour and coalesces them with the
+// stored spans. Spans starting during a stored span of the same host were sent before and are
+// skipped; storeSpans returns how many there were. Samples of entities that haven't been migrated
+// yet are converted to spans on the way.
+func storeSpans(c appengine.Context, hour time.Time, spans []models.Span) (int, error) {
+	var duplicates int
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		duplicates = 0
+		key := datastore.NewKey(c, "HourlyUsage", "", hour.Unix(), nil)
+		storedUsage := models.HourlyUsage{}
+		err := datastore.Get(c, key, &storedUsage)
+		if err != nil {
+			storedUsage = models.HourlyUsage{
+				At: hour,
 			}
+		}
+
+		duplicates = addSpans(&storedUsage, spans)
 
-			uniqueEvents := make(map[string]models.Usage)
-			storedUsage.Events = append(storedUsage.Events, usage...)
-			for _, event := range storedUsage.Events {
-				uniqueEvents[fmt.Sprintf("%s__%s", event.Hostname, event.At)] = event
+		_, err = datastore.Put(c, key, &storedUsage)
+		if err != nil {
+			return fmt.Errorf("Failed to save usage for %s: %v", hour, err)
+		}
+		return nil
+	}, nil)
+	return duplicates, err
+}
+
+// importBatchSize is the number of hours storeHours saves per transaction, the most entity groups
+// a cross-group transaction may touch.
+const importBatchSize = 25
+
+// storeHours adds the spans of many hours to their HourlyUsage entities like storeSpans, but saves
+// importBatchSize hours per transaction so that large imports fit into a request. It returns how
+// many spans were duplicates.
+func storeHours(c appengine.Context, spansByHour map[time.Time][]models.Span) (int, error) {
+	var hours []time.Time
+	for hour := range spansByHour {
+		hours = append(hours, hour)
+	}
+	var total int
+	for start := 0; start < len(hours); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(hours) {
+			end = len(hours)
+		}
+		batch := hours[start:end]
+		var duplicates int
+		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			duplicates = 0
+			keys := make([]*datastore.Key, len(batch))
+			for i, hour := range batch {
+				keys[i] = datastore.NewKey(c, "HourlyUsage", "", hour.Unix(), nil)
 			}
-			storedUsage.Events = []models.Usage{}
-			for _, event := range uniqueEvents {
-				storedUsage.Events = append(storedUsage.Events, event)
+			stored := make([]models.HourlyUsage, len(batch))
+			if err := datastore.GetMulti(c, keys, stored); err != nil {
+				errs, ok := err.(appengine.MultiError)
+				if !ok {
+					return fmt.Errorf("Failed to load usage: %v", err)
+				}
+				for i, err := range errs {
+					if err == datastore.ErrNoSuchEntity {
+						stored[i] = models.HourlyUsage{At: batch[i]}
+					} else if err != nil {
+						return fmt.Errorf("Failed to load usage for %s: %v", batch[i], err)
+					}
+				}
 			}
-
-			_, err = datastore.Put(c, key, &storedUsage)
-			if err != nil {
-				return fmt.Errorf("Failed to save usage for %s: %v", hour, err)
+			for i, hour := range batch {
+				duplicates += addSpans(&stored[i], spansByHour[hour])
+			}
+			if _, err := datastore.PutMulti(c, keys, stored); err != nil {
+				return fmt.Errorf("Failed to save usage from %s: %v", batch[0], err)
 			}
 			return nil
-		}, nil)
+		}, &datastore.TransactionOptions{XG: true})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to apply transaction: %v", err), http.StatusInternalServerError)
-			return
+			return total, err
+		}
+		total += duplicates
+	}
+	return total, nil
+}
+
+// addSpans adds spans that aren't duplicates to stored usage, see storeSpans, and returns how many
+// duplicates there were.
+func addSpans(storedUsage *models.HourlyUsage, spans []models.Span) int {
+	var duplicates int
+	stored := common.HourlySpans(*storedUsage)
+	for _, span := range spans {
+		if isDuplicate(span, stored) {
+			duplicates++
+			continue
+		}
+		stored = append(stored, span)
+	}
+	storedUsage.Spans = common.Coalesce(stored)
+	storedUsage.Events = nil
+	return duplicates
+}
+
+// isDuplicate returns whether span starts during one of spans of the same host.
+func isDuplicate(span models.Span, spans []models.Span) bool {
+	for _, s := range spans {
+		if s.Hostname == span.Hostname && !span.Start.Before(s.Start) && !span.Start.After(common.LastSample(s)) {
+			return true
 		}
 	}
+	return false
 }
@@ -48,7 +48,7 @@ func incomingMail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var csvs []Part
+	var csvs, calendars []Part
 	reader := multipart.NewReader(msg.Body, params["boundary"])
 	for nestedPart, err := reader.NextPart(); err == nil; nestedPart, err = reader.NextPart() {
 		childParts, err := flatten(nestedPart)
@@ -60,26 +60,35 @@ func incomingMail(w http.ResponseWriter, r *http.Request) {
 			if strings.Contains(part.Header.Get("Content-Type"), "text/csv") {
 				csvs = append(csvs, part)
 			}
+			if strings.Contains(part.Header.Get("Content-Type"), "text/calendar") {
+				calendars = append(calendars, part)
+			}
 		}
 	}
 
-	if len(csvs) == 0 {
-		c.Errorf("Expected at least one CSV")
+	if len(csvs) == 0 && len(calendars) == 0 {
+		c.Errorf("Expected at least one CSV or calendar")
 		return
 	}
 
+	for _, file := range calendars {
+		content, err := partContent(file)
+		if err != nil {
+			c.Errorf("%v", err)
+			continue
+		}
+		if _, err := importCalendar(c, strings.NewReader(content), ""); err != nil {
+			c.Errorf("Failed to import calendar %s: %v", file.Filename, err)
+		}
+	}
+
 	for _, file := range csvs {
-		content := file.Content
-		if file.Header.Get("Content-Transfer-Encoding") == "base64" {
-			data, err := base64.StdEncoding.DecodeString(content)
-			if err != nil {
-				c.Errorf("Failed to decode base64: %v", err)
-				continue
-			}
-			content = string(data)
-		} else {
-			content = strings.Trim(content, " \n\r")
+		content, err := partContent(file)
+		if err != nil {
+			c.Errorf("%v", err)
+			continue
 		}
+		content = strings.Trim(content, " \n\r")
 
 		reader := csv.NewReader(strings.NewReader(content))
 		records, err := reader.ReadAll()
@@ -125,6 +134,14 @@ func incomingMail(w http.ResponseWriter, r *http.Request) {
 			c.Errorf("Failed to save tube journey: %v", err)
 			continue
 		}
+
+		err = fireEvent(c, eventTubeImported, map[string]interface{}{
+			"count":    len(tubes),
+			"journeys": tubes,
+		})
+		if err != nil {
+			c.Errorf("Failed to fire event: %v", err)
+		}
 	}
 }
 
@@ -173,6 +190,18 @@ func flatten(part *multipart.Part) ([]Part, error) {
 	return parts, nil
 }
 
+// partContent returns the decoded content of part.
+func partContent(part Part) (string, error) {
+	if part.Header.Get("Content-Transfer-Encoding") == "base64" {
+		data, err := base64.StdEncoding.DecodeString(part.Content)
+		if err != nil {
+			return "", fmt.Errorf("Failed to decode base64: %v", err)
+		}
+		return string(data), nil
+	}
+	return part.Content, nil
+}
+
 type Part struct {
 	Content  string
 	Filename string
@@ -64,6 +64,15 @@ func midiHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = fireEvent(c, eventPracticeSaved, map[string]interface{}{
+		"start":          piece.Start,
+		"length_seconds": int64(piece.Length.Seconds()),
+		"notes":          len(piece.Notes),
+	})
+	if err != nil {
+		c.Errorf("Failed to fire event: %v", err)
+	}
+
 	if err := beeminder.Update(c, "piano", piece.Length.Minutes()); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to update beeminder: %v", err), http.StatusInternalServerError)
 		c.Errorf("Failed to update beeminder: %v", err)
@@ -0,0 +1,90 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+
+	"common"
+	"models"
+)
+
+// migrateBatchSize is the number of entities migrateSpansHandler looks at per request.
+const migrateBatchSize = 50
+
+func init() {
+	http.HandleFunc("/migrate/spans/", migrateSpansHandler)
+}
+
+// migrateSpansHandler rewrites HourlyUsage entities that still store individual samples to store
+// spans instead. It handles migrateBatchSize entities per request and responds with the cursor to
+// continue from, which is empty once all entities have been looked at.
+func migrateSpansHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	q := datastore.NewQuery("HourlyUsage").Order("At").KeysOnly()
+	if r.FormValue("cursor") != "" {
+		cursor, err := datastore.DecodeCursor(r.FormValue("cursor"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode cursor: %v", err), http.StatusBadRequest)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	var response struct {
+		Migrated int    `json:"migrated"`
+		Cursor   string `json:"cursor"`
+	}
+	it := q.Run(c)
+	done := false
+	for i := 0; i < migrateBatchSize; i++ {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			done = true
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to query usage logs: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		migrated := false
+		err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+			var hourlyUsage models.HourlyUsage
+			if err := datastore.Get(c, key, &hourlyUsage); err != nil {
+				return err
+			}
+			if len(hourlyUsage.Events) == 0 {
+				return nil
+			}
+			hourlyUsage.Spans = common.HourlySpans(hourlyUsage)
+			hourlyUsage.Events = nil
+			_, err := datastore.Put(c, key, &hourlyUsage)
+			migrated = err == nil
+			return err
+		}, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to migrate %v: %v", key.IntID(), err), http.StatusInternalServerError)
+			return
+		}
+		if migrated {
+			response.Migrated++
+		}
+	}
+
+	if !done {
+		cursor, err := it.Cursor()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get cursor: %v", err), http.StatusInternalServerError)
+			return
+		}
+		response.Cursor = cursor.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -21,7 +21,21 @@ type Note struct {
 
 type HourlyUsage struct {
 	At     time.Time // Hour of the usage
-	Events []Usage   `datastore:",noindex"`
+	Events []Usage   `datastore:",noindex"` // Individual samples, only in entities not yet migrated
+	Spans  []Span    `datastore:",noindex"`
+}
+
+// Span is a run of consecutive samples of a host with the same focused window. The time since the
+// last activity grows with the time between samples unless the user was active, so LastActivity of
+// the last sample is enough to reconstruct it for all samples: it's never more than LastActivity
+// minus the time until the last sample.
+type Span struct {
+	Start        time.Time     `datastore:",noindex"` // Time of the first sample
+	End          time.Time     `datastore:",noindex"` // Time of the last sample plus Interval
+	Focused      App           `datastore:",noindex"`
+	LastActivity time.Duration `datastore:",noindex"` // Time since the last activity at the last sample
+	Hostname     string        `datastore:",noindex"`
+	Interval     time.Duration `datastore:",noindex"`
 }
 
 type Usage struct {
@@ -29,6 +43,7 @@ type Usage struct {
 	Focused      App           `datastore:",noindex"`
 	LastActivity time.Duration `datastore:",noindex"`
 	Hostname     string        `datastore:",noindex"`
+	Interval     time.Duration `datastore:",noindex"` // Sampling interval declared by the client, if any
 }
 
 type App struct {
@@ -42,3 +57,85 @@ type Tube struct {
 	From  string    `datastore:",noindex"`
 	To    string    `datastore:",noindex"`
 }
+
+// Meeting is an event imported from a calendar.
+type Meeting struct {
+	Start    time.Time
+	End      time.Time `datastore:",noindex"`
+	Summary  string    `datastore:",noindex"`
+	UID      string    `datastore:",noindex"` // UID of the event in the calendar, shared by all occurrences
+	Calendar string    `datastore:",noindex"`
+}
+
+// Annotation labels a range of time with what was done, for when the tracker couldn't know.
+type Annotation struct {
+	Start    time.Time
+	End      time.Time `datastore:",noindex"`
+	Label    string    `datastore:",noindex"`
+	Category string    `datastore:",noindex"` // Path in the usage tree, e.g. "reading/papers"
+	Created  time.Time `datastore:",noindex"`
+}
+
+// RuleSet is a version of the rules that categorize usage. Old versions are kept so that reports
+// can be reproduced with the rules they were made with.
+type RuleSet struct {
+	Version      int64
+	Created      time.Time `datastore:",noindex"`
+	Comment      string    `datastore:",noindex"`
+	Rules        string    `datastore:",noindex"` // JSON list of usage.Rule
+	Productivity string    `datastore:",noindex"` // JSON list of usage.ProductivityRule, empty for the defaults
+}
+
+// RepoIndex lists the git repositories on a host, as uploaded by its collector.
+type RepoIndex struct {
+	Hostname string
+	Paths    []string  `datastore:",noindex"` // Working trees, with the home directory as "~"
+	Updated  time.Time `datastore:",noindex"`
+}
+
+// Commit is a commit imported from a git log export.
+type Commit struct {
+	Repo    string
+	Hash    string `datastore:",noindex"`
+	Time    time.Time
+	Author  string `datastore:",noindex"`
+	Subject string `datastore:",noindex"`
+}
+
+// HostClock is the clock skew of a host, estimated from the time the host sends along with logs.
+type HostClock struct {
+	Hostname string
+	Skew     time.Duration `datastore:",noindex"` // Server time minus host time
+	Measured time.Time     `datastore:",noindex"`
+	Correct  bool          `datastore:",noindex"` // Whether to shift the logs of the host by Skew
+}
+
+// SilentDevice records that a device stopped logging, so that it's only reported once.
+type SilentDevice struct {
+	Device   string
+	LastSeen time.Time `datastore:",noindex"` // Time of the last sample before it went silent
+}
+
+// BudgetAlert records that a notification was sent because a budget wasn't kept on a day, so that
+// it's only sent once.
+type BudgetAlert struct {
+	Budget string
+	Day    time.Time
+	Spent  time.Duration `datastore:",noindex"`
+	Sent   time.Time     `datastore:",noindex"`
+	Mailed bool          `datastore:",noindex"` // Whether the mail was sent
+	Fired  bool          `datastore:",noindex"` // Whether the webhook event was queued
+	// RulesVersion is the version of the rules the spent time was categorized with, 0 for the
+	// built-in rules.
+	RulesVersion int64 `datastore:",noindex"`
+}
+
+// SentDigest records that a digest was mailed to a recipient, so that it's only sent once even if
+// sending it to another recipient fails and the digest is retried.
+type SentDigest struct {
+	Period       string    // "daily" or "weekly"
+	From         time.Time // Start of the period covered by the digest
+	Recipient    string    // Empty for the admins of the app
+	Sent         time.Time `datastore:",noindex"`
+	RulesVersion int64     `datastore:",noindex"` // Version of the rules the digest was categorized with
+}
@@ -0,0 +1,309 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"importer"
+	"models"
+	"usage"
+)
+
+// repoPaths maps working trees of git repositories to the names they are shown with, in addition
+// to the repositories uploaded by collectors, e.g. "~/Programmieren/app-usage": "app-usage".
+var repoPaths = map[string]string{}
+
+// noRepo is the row for time spent editing files that aren't part of a known repository. Terminals
+// outside of known repositories aren't counted.
+const noRepo = "(no repository)"
+
+// reposMaxRange is the longest range /repos/ shows at once.
+const reposMaxRange = 92 * 24 * time.Hour
+
+var reposTemplate = template.Must(template.ParseFiles("templates/repos.html"))
+
+func init() {
+	http.HandleFunc("/repos/", reposHandler)
+	http.HandleFunc("/repos/index/", repoIndexHandler)
+}
+
+// RepoRow is the coding time and number of commits of a repository in each column of /repos/.
+type RepoRow struct {
+	Name         string
+	Coding       []time.Duration
+	Commits      []int
+	TotalCoding  time.Duration
+	TotalCommits int
+}
+
+type repoRoot struct {
+	Path string
+	Name string
+}
+
+// repoIndexHandler saves the git repositories of a host, sent by its collector as JSON like
+// {"hostname": "laptop", "paths": ["~/Programmieren/app-usage"]}.
+func repoIndexHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		http.Error(w, "Uploading repositories requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var upload struct {
+		Hostname string   `json:"hostname"`
+		Paths    []string `json:"paths"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse repositories: %v", err), http.StatusBadRequest)
+		return
+	}
+	if upload.Hostname == "" {
+		http.Error(w, "Missing hostname", http.StatusBadRequest)
+		return
+	}
+	index := models.RepoIndex{
+		Hostname: upload.Hostname,
+		Paths:    upload.Paths,
+		Updated:  time.Now(),
+	}
+	if _, err := datastore.Put(c, datastore.NewKey(c, "RepoIndex", index.Hostname, 0, nil), &index); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save repositories: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Saved %d repositories of %s\n", len(index.Paths), index.Hostname)
+}
+
+// reposHandler shows how much time was spent coding in each repository and how many commits were
+// made to it, per day or with by=week per week.
+func reposHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := parseDateRange(r, loc, 7)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > reposMaxRange {
+		http.Error(w, fmt.Sprintf("Range from %s to %s is longer than %v", from, to, reposMaxRange), http.StatusBadRequest)
+		return
+	}
+	rules, err := requestRules(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	weekly := r.FormValue("by") == "week"
+
+	var columns []time.Time
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !weekly || len(columns) == 0 || day.Weekday() == time.Monday {
+			columns = append(columns, day)
+		}
+	}
+	column := func(t time.Time) int {
+		return sort.Search(len(columns), func(i int) bool { return columns[i].After(t) }) - 1
+	}
+
+	roots, err := loadRepoRoots(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows := make(map[string]*RepoRow)
+	row := func(name string) *RepoRow {
+		if _, ok := rows[name]; !ok {
+			rows[name] = &RepoRow{
+				Name:    name,
+				Coding:  make([]time.Duration, len(columns)),
+				Commits: make([]int, len(columns)),
+			}
+		}
+		return rows[name]
+	}
+
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		usages, err := queryUsage(c, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to query usage logs: %v", err), http.StatusInternalServerError)
+			return
+		}
+		logger, err := usage.MakeLogger(rules.Rules, usage.DefaultEditorDepth)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create logger: %v", err), http.StatusInternalServerError)
+			return
+		}
+		repos := &repoLogger{Logger: logger, roots: roots, durations: make(map[string]time.Duration)}
+		spansByDevice, _ := filterIdles(usages)
+		addUsage(repos, spansByDevice, devicePriority("", spansByDevice))
+		for name, length := range repos.durations {
+			row(name).Coding[column(day)] += length
+		}
+	}
+
+	q := datastore.NewQuery("Commit").
+		Filter("Time >=", from).
+		Filter("Time <", to).
+		Order("Time")
+	var commits []models.Commit
+	if _, err := q.GetAll(c, &commits); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query commits: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, commit := range commits {
+		row(commit.Repo).Commits[column(commit.Time.In(loc))]++
+	}
+
+	var sorted []RepoRow
+	for _, repo := range rows {
+		for i := range repo.Coding {
+			repo.Coding[i] = roundMinutes(repo.Coding[i])
+			repo.TotalCoding += repo.Coding[i]
+			repo.TotalCommits += repo.Commits[i]
+		}
+		sorted = append(sorted, *repo)
+	}
+	sort.Sort(byRepoTotal(sorted))
+
+	var labels []string
+	for _, start := range columns {
+		if weekly {
+			labels = append(labels, "week of "+start.Format("Jan 2"))
+		} else {
+			labels = append(labels, start.Format("Mon Jan 2"))
+		}
+	}
+	data := map[string]interface{}{
+		"From":         from.Format("2006-01-02"),
+		"To":           to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"Weekly":       weekly,
+		"Columns":      labels,
+		"Repos":        sorted,
+		"GitLogFormat": importer.GitLogFormat,
+	}
+	if err := reposTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// loadRepoRoots returns the configured repositories and those uploaded by collectors, longest path
+// first so that nested repositories take precedence.
+func loadRepoRoots(c appengine.Context) ([]repoRoot, error) {
+	var roots []repoRoot
+	for p, name := range repoPaths {
+		roots = append(roots, repoRoot{strings.TrimSuffix(p, "/"), name})
+	}
+	var indexes []models.RepoIndex
+	if _, err := datastore.NewQuery("RepoIndex").GetAll(c, &indexes); err != nil {
+		return nil, fmt.Errorf("Failed to query repositories: %v", err)
+	}
+	for _, index := range indexes {
+		for _, p := range index.Paths {
+			p = strings.TrimSuffix(p, "/")
+			if _, ok := repoPaths[p]; !ok {
+				roots = append(roots, repoRoot{p, path.Base(p)})
+			}
+		}
+	}
+	sort.Sort(byPathLength(roots))
+	return roots, nil
+}
+
+// repoFor returns the name of the repository loc is in. Without a path, the repository is the one
+// named like the project.
+func repoFor(roots []repoRoot, loc usage.Location) string {
+	if loc.Path != "" {
+		for _, root := range roots {
+			if loc.Path == root.Path || strings.HasPrefix(loc.Path, root.Path+"/") {
+				return root.Name
+			}
+		}
+	}
+	if loc.Project != "" {
+		for _, root := range roots {
+			if root.Name == loc.Project {
+				return root.Name
+			}
+		}
+	}
+	return noRepo
+}
+
+// repoLogger sums up time by the repository each span happened in, skipping spans that aren't in
+// any file or directory and terminals outside of known repositories, like the home directory.
+type repoLogger struct {
+	usage.Logger
+	roots     []repoRoot
+	durations map[string]time.Duration
+}
+
+func (l *repoLogger) AddSpan(span models.Span) {
+	locator, ok := l.Logger.(usage.Locator)
+	if !ok {
+		return
+	}
+	if loc, ok := locator.Location(span); ok {
+		repo := repoFor(l.roots, loc)
+		if category := l.Category(span); repo == noRepo && len(category) > 0 && category[0] == "terminal" {
+			return
+		}
+		l.durations[repo] += span.End.Sub(span.Start)
+	}
+}
+
+// importCommits saves commits, keyed by repository and hash so that importing a log again doesn't
+// duplicate them.
+func importCommits(c appengine.Context, commits []models.Commit) error {
+	for start := 0; start < len(commits); start += restoreBatchSize {
+		end := start + restoreBatchSize
+		if end > len(commits) {
+			end = len(commits)
+		}
+		var keys []*datastore.Key
+		var batch []*models.Commit
+		for i := range commits[start:end] {
+			commit := &commits[start+i]
+			keys = append(keys, commitKey(c, *commit))
+			batch = append(batch, commit)
+		}
+		if _, err := datastore.PutMulti(c, keys, batch); err != nil {
+			return fmt.Errorf("Failed to save commits: %v", err)
+		}
+	}
+	return nil
+}
+
+func commitKey(c appengine.Context, commit models.Commit) *datastore.Key {
+	return datastore.NewKey(c, "Commit", commit.Repo+"/"+commit.Hash, 0, nil)
+}
+
+type byRepoTotal []RepoRow
+
+func (a byRepoTotal) Len() int      { return len(a) }
+func (a byRepoTotal) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRepoTotal) Less(i, j int) bool {
+	if a[i].TotalCoding != a[j].TotalCoding {
+		return a[i].TotalCoding > a[j].TotalCoding
+	}
+	return a[i].Name < a[j].Name
+}
+
+type byPathLength []repoRoot
+
+func (a byPathLength) Len() int           { return len(a) }
+func (a byPathLength) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPathLength) Less(i, j int) bool { return len(a[i].Path) > len(a[j].Path) }
@@ -0,0 +1,408 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"models"
+	"usage"
+)
+
+// maxRuleDiffRows is the number of changed categories shown when previewing rules.
+const maxRuleDiffRows = 200
+
+// ruleDiffMaxRange is the longest range rules can be previewed on, since each day is categorized
+// twice.
+const ruleDiffMaxRange = 31 * 24 * time.Hour
+
+var rulesTemplate = template.Must(template.ParseFiles("templates/rules.html"))
+
+func init() {
+	http.HandleFunc("/admin/rules/", rulesHandler)
+}
+
+// RuleDiff is how the time attributed to a node of the usage tree changes with new rules.
+type RuleDiff struct {
+	Category string
+	Before   time.Duration
+	After    time.Duration
+	Change   string
+}
+
+// ProductivityDiff is how the productivity of the previewed range changes with new rules.
+type ProductivityDiff struct {
+	Before usage.ProductivityReport
+	After  usage.ProductivityReport
+}
+
+// loadedRules is a version of the rules that categorize and score usage.
+type loadedRules struct {
+	Version      int64 // 0 before any rules were saved
+	Rules        []usage.Rule
+	Productivity []usage.ProductivityRule
+}
+
+// loadRules returns the rules of the given version, or of the latest version if version is 0.
+// Before any rules were saved, there are no categorization rules and the default productivity
+// rules.
+func loadRules(c appengine.Context, version int64) (loadedRules, error) {
+	var ruleSet models.RuleSet
+	if version != 0 {
+		err := datastore.Get(c, datastore.NewKey(c, "RuleSet", "", version, nil), &ruleSet)
+		if err != nil {
+			return loadedRules{}, fmt.Errorf("Failed to get rules version %d: %v", version, err)
+		}
+	} else {
+		var ruleSets []models.RuleSet
+		if _, err := datastore.NewQuery("RuleSet").Order("-Version").Limit(1).GetAll(c, &ruleSets); err != nil {
+			return loadedRules{}, fmt.Errorf("Failed to query rules: %v", err)
+		}
+		if len(ruleSets) == 0 {
+			return loadedRules{Productivity: usage.DefaultProductivityRules}, nil
+		}
+		ruleSet = ruleSets[0]
+	}
+	rules, err := parseRules(ruleSet.Rules)
+	if err != nil {
+		return loadedRules{}, fmt.Errorf("Failed to parse rules version %d: %v", ruleSet.Version, err)
+	}
+	productivity, err := parseProductivityRules(ruleSet.Productivity)
+	if err != nil {
+		return loadedRules{}, fmt.Errorf("Failed to parse productivity rules version %d: %v", ruleSet.Version, err)
+	}
+	return loadedRules{ruleSet.Version, rules, productivity}, nil
+}
+
+// rulesVersionName describes the rules with the given version for digests and notifications.
+func rulesVersionName(version int64) string {
+	if version == 0 {
+		return "the built-in rules"
+	}
+	return fmt.Sprintf("rules version %d", version)
+}
+
+// requestRules loads the rules version given by the rules form value, or the latest version.
+func requestRules(c appengine.Context, r *http.Request) (loadedRules, error) {
+	var version int64
+	if r.FormValue("rules") != "" {
+		var err error
+		if version, err = strconv.ParseInt(r.FormValue("rules"), 10, 64); err != nil || version < 1 {
+			return loadedRules{}, fmt.Errorf("Invalid rules version %q", r.FormValue("rules"))
+		}
+	}
+	return loadRules(c, version)
+}
+
+func parseRules(data string) ([]usage.Rule, error) {
+	var rules []usage.Rule
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, err
+	}
+	// Make sure the rules compile.
+	if _, err := usage.MakeLogger(rules, usage.DefaultEditorDepth); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// parseProductivityRules parses a JSON list of productivity rules, which is empty for the defaults.
+func parseProductivityRules(data string) ([]usage.ProductivityRule, error) {
+	if strings.TrimSpace(data) == "" {
+		return usage.DefaultProductivityRules, nil
+	}
+	var rules []usage.ProductivityRule
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if len(rule.Category) == 0 {
+			return nil, fmt.Errorf("Productivity rule %d has no category", i+1)
+		}
+		if rule.Productivity < usage.VeryDistracting || rule.Productivity > usage.VeryProductive {
+			return nil, fmt.Errorf("Productivity rule %d has productivity %d, expected -2 to 2", i+1, rule.Productivity)
+		}
+	}
+	return rules, nil
+}
+
+// rulesHandler shows the current rules and productivity rules for editing. Candidate rules can be
+// previewed over a date range as a diff of the usage tree against the current rules, and saved as a
+// new version.
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := location()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load timezone: %v", err), http.StatusInternalServerError)
+		return
+	}
+	current, err := loadRules(c, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["Version"] = current.Version
+	data["NextVersion"] = current.Version + 1
+	data["From"] = r.FormValue("from")
+	data["To"] = r.FormValue("to")
+	data["Comment"] = r.FormValue("comment")
+
+	editing := current
+	if r.FormValue("version") != "" {
+		v, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid version %q", r.FormValue("version")), http.StatusBadRequest)
+			return
+		}
+		if editing, err = loadRules(c, v); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	if editing.Rules == nil {
+		editing.Rules = []usage.Rule{}
+	}
+	text, err := json.MarshalIndent(editing.Rules, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["Rules"] = string(text)
+	// Unclassified categories on the graph page link here with a draft productivity rule to fill in.
+	if category := strings.Trim(r.FormValue("category"), "/"); category != "" {
+		draft := strings.Split(category, "/")
+		if _, ok := usage.Score(editing.Productivity, draft); !ok {
+			editing.Productivity = append(append([]usage.ProductivityRule(nil), editing.Productivity...),
+				usage.ProductivityRule{Category: draft, Productivity: usage.Neutral})
+			data["Draft"] = category
+		}
+	}
+	text, err = json.MarshalIndent(editing.Productivity, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["Productivity"] = string(text)
+
+	if r.Method == "POST" {
+		data["Rules"] = r.FormValue("rules")
+		data["Productivity"] = r.FormValue("productivity")
+		var candidate loadedRules
+		if candidate.Rules, err = parseRules(r.FormValue("rules")); err != nil {
+			data["Error"] = fmt.Sprintf("Invalid rules: %v", err)
+		} else if candidate.Productivity, err = parseProductivityRules(r.FormValue("productivity")); err != nil {
+			data["Error"] = fmt.Sprintf("Invalid productivity rules: %v", err)
+		} else if r.FormValue("action") == "save" {
+			newVersion, err := saveRules(c, r.FormValue("rules"), r.FormValue("productivity"), r.FormValue("comment"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			c.Infof("Saved rules version %d", newVersion)
+			http.Redirect(w, r, "/admin/rules/", http.StatusSeeOther)
+			return
+		} else {
+			from, to, err := parseDateRange(r, loc, 7)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if to.Sub(from) > ruleDiffMaxRange {
+				http.Error(w, fmt.Sprintf("Range from %s to %s is longer than %v", from, to, ruleDiffMaxRange), http.StatusBadRequest)
+				return
+			}
+			diff, productivity, err := ruleDiff(c, from, to, current, candidate)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data["Diff"] = diff
+			data["ProductivityDiff"] = productivity
+			data["Previewed"] = true
+		}
+	}
+
+	var ruleSets []models.RuleSet
+	if _, err := datastore.NewQuery("RuleSet").Order("-Version").GetAll(c, &ruleSets); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query rules: %v", err), http.StatusInternalServerError)
+		return
+	}
+	data["RuleSets"] = ruleSets
+
+	if err := rulesTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// saveRules saves rules and productivity rules as a new version and returns it.
+func saveRules(c appengine.Context, rules, productivity, comment string) (int64, error) {
+	latest, err := loadRules(c, 0)
+	if err != nil {
+		return 0, err
+	}
+	version := latest.Version + 1
+	key := datastore.NewKey(c, "RuleSet", "", version, nil)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var existing models.RuleSet
+		if err := datastore.Get(c, key, &existing); err != datastore.ErrNoSuchEntity {
+			if err == nil {
+				return fmt.Errorf("Version %d was saved in the meantime", version)
+			}
+			return err
+		}
+		ruleSet := models.RuleSet{
+			Version:      version,
+			Created:      time.Now(),
+			Comment:      comment,
+			Rules:        rules,
+			Productivity: productivity,
+		}
+		_, err := datastore.Put(c, key, &ruleSet)
+		return err
+	}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to save rules: %v", err)
+	}
+	return version, nil
+}
+
+// ruleDiff categorizes and scores the usage in [from, to) with both versions of the rules, counted
+// like on the graph page, and returns the nodes of the usage tree whose time changed, most changed
+// first, and how the productivity changed.
+func ruleDiff(c appengine.Context, from, to time.Time, before, after loadedRules) ([]RuleDiff, ProductivityDiff, error) {
+	var productivity ProductivityDiff
+	beforeLogger, err := makeDiffLogger(before)
+	if err != nil {
+		return nil, productivity, err
+	}
+	afterLogger, err := makeDiffLogger(after)
+	if err != nil {
+		return nil, productivity, err
+	}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		end := day.AddDate(0, 0, 1)
+		if end.After(to) {
+			end = to
+		}
+		usages, err := queryUsage(c, day, end)
+		if err != nil {
+			return nil, productivity, fmt.Errorf("Failed to query usage logs: %v", err)
+		}
+		pieces, err := queryPieces(c, day, end)
+		if err != nil {
+			return nil, productivity, fmt.Errorf("Failed to query midi logs: %v", err)
+		}
+		meetings, err := queryMeetings(c, day, end)
+		if err != nil {
+			return nil, productivity, fmt.Errorf("Failed to query meetings: %v", err)
+		}
+		annotations, _, err := queryAnnotations(c, day, end)
+		if err != nil {
+			return nil, productivity, fmt.Errorf("Failed to query annotations: %v", err)
+		}
+		spansByDevice, _ := filterIdles(usages)
+		priority := devicePriority("", spansByDevice)
+		for _, logger := range []usage.Logger{beforeLogger, afterLogger} {
+			addDayUsage(logger, day, spansByDevice, priority, meetings, annotations)
+			for _, piece := range pieces {
+				logger.AddSpan(pieceSpan(piece))
+			}
+		}
+	}
+	productivity.Before = beforeLogger.Report(0)
+	productivity.After = afterLogger.Report(0)
+
+	beforeSizes := make(map[string]int64)
+	flattenTree(beforeLogger.Serialize(), "", beforeSizes)
+	afterSizes := make(map[string]int64)
+	flattenTree(afterLogger.Serialize(), "", afterSizes)
+
+	var diff []RuleDiff
+	for category := range beforeSizes {
+		if _, ok := afterSizes[category]; !ok {
+			afterSizes[category] = 0
+		}
+	}
+	for category, seconds := range afterSizes {
+		if beforeSizes[category] == seconds {
+			continue
+		}
+		b := time.Duration(beforeSizes[category]) * time.Second
+		a := time.Duration(seconds) * time.Second
+		diff = append(diff, RuleDiff{
+			Category: category,
+			Before:   b,
+			After:    a,
+			Change:   signedDuration(a - b),
+		})
+	}
+	sort.Sort(byChange(diff))
+	if len(diff) > maxRuleDiffRows {
+		diff = diff[:maxRuleDiffRows]
+	}
+	return diff, productivity, nil
+}
+
+func makeDiffLogger(rules loadedRules) (*usage.ProductivityLogger, error) {
+	logger, err := usage.MakeLogger(rules.Rules, usage.DefaultEditorDepth)
+	if err != nil {
+		return nil, err
+	}
+	return usage.MakeProductivityLogger(logger, rules.Rules, rules.Productivity)
+}
+
+func signedDuration(d time.Duration) string {
+	if d > 0 {
+		return "+" + d.String()
+	}
+	return d.String()
+}
+
+// flattenTree adds the total size in seconds of every node below node to sizes, keyed by its path,
+// e.g. "chrome/github".
+func flattenTree(node map[string]interface{}, path string, sizes map[string]int64) int64 {
+	children, ok := node["children"].([]interface{})
+	if !ok {
+		size, _ := node["size"].(int64)
+		return size
+	}
+	var total int64
+	for _, c := range children {
+		child := c.(map[string]interface{})
+		childPath := child["name"].(string)
+		if path != "" {
+			childPath = path + "/" + childPath
+		}
+		size := flattenTree(child, childPath, sizes)
+		sizes[childPath] += size
+		total += size
+	}
+	return total
+}
+
+type byChange []RuleDiff
+
+func (a byChange) Len() int      { return len(a) }
+func (a byChange) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byChange) Less(i, j int) bool {
+	ci, cj := absDuration(a[i].After-a[i].Before), absDuration(a[j].After-a[j].Before)
+	if ci != cj {
+		return ci > cj
+	}
+	return a[i].Category < a[j].Category
+}
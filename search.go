@@ -0,0 +1,193 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"models"
+)
+
+var searchTemplate = template.Must(template.ParseFiles("templates/search.html"))
+
+// searchMaxRange is the longest range that can be searched at once, since every span in it is
+// matched against the query.
+const searchMaxRange = 31 * 24 * time.Hour
+
+func init() {
+	http.HandleFunc("/search/", searchHandler)
+	http.HandleFunc("/api/search/", searchAPIHandler)
+}
+
+// SearchResult is a contiguous range of time during which a device was focused on matching windows.
+type SearchResult struct {
+	Device   string
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+	Titles   []string
+}
+
+type searchResponse struct {
+	Results []SearchResult
+	Total   time.Duration
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["Query"] = r.FormValue("q")
+	data["Field"] = r.FormValue("field")
+	data["Regex"] = r.FormValue("regex") != ""
+	data["From"] = r.FormValue("from")
+	data["To"] = r.FormValue("to")
+
+	if r.FormValue("q") != "" {
+		response, err := search(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data["Results"] = response.Results
+		data["Total"] = response.Total
+	}
+
+	if err := searchTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func searchAPIHandler(w http.ResponseWriter, r *http.Request) {
+	response, err := search(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// search finds all non-idle usage in the requested date range whose field (title, process,
+// hostname or any of them) matches q, either as a substring or as a regular expression.
+func search(r *http.Request) (*searchResponse, error) {
+	c := appengine.NewContext(r)
+
+	matches, err := makeMatcher(r.FormValue("q"), r.FormValue("regex") != "")
+	if err != nil {
+		return nil, err
+	}
+	var fields func(models.Span) []string
+	switch r.FormValue("field") {
+	case "title":
+		fields = func(s models.Span) []string { return []string{s.Focused.WindowTitle} }
+	case "process":
+		fields = func(s models.Span) []string { return []string{s.Focused.Process} }
+	case "hostname":
+		fields = func(s models.Span) []string { return []string{s.Hostname} }
+	case "", "any":
+		fields = func(s models.Span) []string {
+			return []string{s.Focused.WindowTitle, s.Focused.Process, s.Hostname}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown field %q", r.FormValue("field"))
+	}
+
+	loc, err := location()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	from, to, err := parseDateRange(r, loc, 30)
+	if err != nil {
+		return nil, err
+	}
+	if to.Sub(from) > searchMaxRange {
+		return nil, fmt.Errorf("Range from %s to %s is longer than %v", from, to, searchMaxRange)
+	}
+	usages, err := queryUsage(c, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query usage logs: %v", err)
+	}
+
+	response := &searchResponse{}
+	var matched []period
+	spansByDevice, _ := filterIdles(usages)
+	for device, spans := range spansByDevice {
+		var result *SearchResult
+		for _, span := range spans {
+			if !matchesAny(matches, fields(span)) {
+				continue
+			}
+
+			matched = append(matched, period{span.Start, span.End})
+			if result == nil || span.Start.After(result.End) {
+				response.Results = append(response.Results, SearchResult{
+					Device: device,
+					Start:  span.Start.In(loc),
+				})
+				result = &response.Results[len(response.Results)-1]
+			}
+			result.End = span.End.In(loc)
+			result.Duration += span.End.Sub(span.Start)
+			if !containsString(result.Titles, span.Focused.WindowTitle) {
+				result.Titles = append(result.Titles, span.Focused.WindowTitle)
+			}
+		}
+	}
+	sort.Sort(byResultStart(response.Results))
+
+	// Matches on several devices at the same time only count once.
+	for _, p := range mergePeriods(matched) {
+		response.Total += p.End.Sub(p.Start)
+	}
+	return response, nil
+}
+
+func makeMatcher(q string, isRegex bool) (func(string) bool, error) {
+	if q == "" {
+		return nil, fmt.Errorf("Empty query")
+	}
+	if !isRegex {
+		q = strings.ToLower(q)
+		return func(s string) bool { return strings.Contains(strings.ToLower(s), q) }, nil
+	}
+	re, err := regexp.Compile(q)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse regex: %v", err)
+	}
+	return re.MatchString, nil
+}
+
+func matchesAny(matches func(string) bool, values []string) bool {
+	for _, v := range values {
+		if matches(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type byResultStart []SearchResult
+
+func (a byResultStart) Len() int           { return len(a) }
+func (a byResultStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byResultStart) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
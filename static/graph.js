@@ -40,6 +40,12 @@ function draw_map(data) {
       .attr("height", function(d) { return d.dy - 1; })
       .style("fill", function(d) { return color(d.parent.name); });
 
+  cell.append("svg:title")
+      .text(function(d) {
+        var p = productivity(d);
+        return d.name + ": " + duration(d.size) + (p === undefined ? "" : " (" + productivityNames[p + 2] + ")");
+      });
+
   cell.append("svg:text")
       .attr("x", function(d) { return d.dx / 2; })
       .attr("y", function(d) { return d.dy / 2; })
@@ -56,6 +62,17 @@ function draw_map(data) {
   });
 };
 
+var productivityNames = ["very distracting", "distracting", "neutral", "productive", "very productive"];
+
+// Returns the productivity of the most specific scored node containing d.
+function productivity(d) {
+  for (; d; d = d.parent) {
+    if (d.productivity !== undefined) {
+      return d.productivity;
+    }
+  }
+}
+
 function duration(length) {
   var label = "";
   if (length > 3600) {
@@ -115,6 +132,37 @@ function timelineRect(intervals) {
 
   var svg = d3.select("#timeline").append("svg").attr("width", w)
     .datum(intervals).call(chart);
+  annotationBrush(svg);
+}
+
+// Lets the user select a range on the timeline to annotate.
+function annotationBrush(svg) {
+  // The timeline covers the day, inside its default margins of 30px.
+  var scale = d3.time.scale()
+      .domain([timestamp * 1000, (timestamp + 86400) * 1000])
+      .range([30, w - 30]);
+  var format = d3.time.format("%H:%M");
+  var brush = d3.svg.brush()
+      .x(scale)
+      .on("brushend", function() {
+        var form = d3.select("#annotate");
+        if (brush.empty()) {
+          form.style("display", null);
+          return;
+        }
+        var extent = brush.extent();
+        form.select("[name=start]").property("value", Math.round(extent[0] / 1000));
+        form.select("[name=end]").property("value", Math.round(extent[1] / 1000));
+        d3.select("#annotate-range").text(format(extent[0]) + " - " + format(extent[1]));
+        form.style("display", "block");
+        form.select("[name=label]").node().focus();
+      });
+  svg.append("g")
+      .attr("class", "brush")
+      .call(brush)
+    .selectAll("rect")
+      .attr("y", 0)
+      .attr("height", svg.attr("height"));
 }
 
 function update() {
@@ -123,15 +171,97 @@ function update() {
  //  document.title = duration(allData[curIdx].total) + " on " + allData[curIdx].date + " - AppUsage";
 }
 
+function graphUrl(ts) {
+  return "/graph/?ts=" + ts + (byDevice ? "&by=device" : "") +
+      (includeIdle ? "&idle=include" : "") + (live ? "&live=1" : "") +
+      (prefer ? "&prefer=" + encodeURIComponent(prefer) : "") +
+      (rules ? "&rules=" + rules : "") +
+      (depth != defaultDepth ? "&depth=" + depth : "");
+}
+
 function older() {
-  window.location = "/graph/?ts=" + (timestamp - 86400);
+  window.location = graphUrl(timestamp - 86400);
 }
 
 function newer() {
-  window.location = "/graph/?ts=" + (timestamp + 86400);
+  window.location = graphUrl(timestamp + 86400);
+}
+
+function toggleByDevice() {
+  byDevice = !byDevice;
+  window.location = graphUrl(timestamp);
+}
+
+function toggleIncludeIdle() {
+  includeIdle = !includeIdle;
+  window.location = graphUrl(timestamp);
+}
+
+function changeDepth(value) {
+  depth = parseInt(value, 10);
+  window.location = graphUrl(timestamp);
+}
+
+function changePrefer(device) {
+  prefer = device;
+  window.location = graphUrl(timestamp);
+}
+
+function toggleLive() {
+  live = !live;
+  window.location = graphUrl(timestamp);
+}
+
+// Redraws the graph with the latest usage of the day.
+function reload() {
+  d3.json(graphUrl(timestamp) + "&format=json", function(error, data) {
+    if (error) {
+      return;
+    }
+    usage = data.usage;
+    intervals = data.intervals;
+    d3.select("#body").selectAll("*").remove();
+    d3.select("#timeline").selectAll("*").remove();
+    update();
+    d3.select("#productivity").text(data.productivity.scored ?
+        "productivity " + data.productivity.score + ", " +
+        data.productivity.productive_hours.toFixed(1) + "h productive" : "");
+    document.title = data.wall_clock +
+        (data.wall_clock != data.total ? " (" + data.total + " across devices)" : "") +
+        " on " + date + " - App Usage";
+  });
+}
+
+// Shows what each device is focused on right now.
+function showStatus(devices) {
+  var items = d3.select("#now").selectAll("li").data(devices);
+  items.enter().append("li");
+  items.exit().remove();
+  items
+      .attr("class", function(d) { return d.silent ? "silent" : (d.idle ? "idle" : ""); })
+      .text(function(d) {
+        return d.device + ": " + (d.category || d.process) + (d.title ? " - " + d.title : "") +
+            (d.silent ? " (silent)" : (d.idle ? " (idle)" : ""));
+      });
+}
+
+function startLive() {
+  var first = true;
+  var source = new EventSource("/live/");
+  source.addEventListener("status", function(e) {
+    showStatus(JSON.parse(e.data).devices);
+    // The page was just rendered with the usage of the first event.
+    if (!first) {
+      reload();
+    }
+    first = false;
+  });
 }
 
 var curIdx = 0;
 var curIntervals;
 
 update();
+if (live) {
+  startLive();
+}
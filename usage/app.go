@@ -3,7 +3,6 @@ package usage
 import (
 	"time"
 
-	"common"
 	"models"
 )
 
@@ -19,8 +18,12 @@ type appUsage struct {
 	categories map[string]time.Duration
 }
 
-func (a *appUsage) AddUsage(usage models.Usage) {
-	a.categories[usage.Focused.WindowTitle] += common.LogInterval
+func (a *appUsage) AddSpan(span models.Span) {
+	a.categories[span.Focused.WindowTitle] += span.End.Sub(span.Start)
+}
+
+func (a *appUsage) Category(span models.Span) []string {
+	return []string{a.process, span.Focused.WindowTitle}
 }
 
 func (a *appUsage) Serialize() map[string]interface{} {
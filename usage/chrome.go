@@ -5,7 +5,6 @@ import (
 	"strings"
 	"time"
 
-	"common"
 	"models"
 )
 
@@ -19,9 +18,13 @@ type chromeUsage struct {
 	sites map[string]time.Duration
 }
 
-func (c *chromeUsage) AddUsage(usage models.Usage) {
-	host := tryGetHostname(usage.Focused.WindowTitle)
-	c.sites[host] += common.LogInterval
+func (c *chromeUsage) AddSpan(span models.Span) {
+	host := tryGetHostname(span.Focused.WindowTitle)
+	c.sites[host] += span.End.Sub(span.Start)
+}
+
+func (c *chromeUsage) Category(span models.Span) []string {
+	return []string{"chrome", tryGetHostname(span.Focused.WindowTitle)}
 }
 
 func (c *chromeUsage) Serialize() map[string]interface{} {
@@ -43,6 +46,9 @@ func tryGetHostname(name string) string {
 		return parsedUrl.Host
 	}
 	titleParts := strings.Split(name, "-")
+	if len(titleParts) < 2 {
+		return name
+	}
 	host := titleParts[len(titleParts)-2]
 	return strings.Replace(strings.Replace(host, "www.", "", -1), ".com", "", -1)
 }
@@ -0,0 +1,56 @@
+package usage
+
+import (
+	"common"
+	"models"
+)
+
+// MakeDeviceLogger returns a Logger that splits usage by device at the top level of the tree, with
+// the usual per-app breakdown below each device.
+func MakeDeviceLogger(rules []Rule, editorDepth int) (Logger, error) {
+	// Per-device loggers are created lazily, so make sure creating them can't fail later on.
+	if _, err := MakeLogger(rules, editorDepth); err != nil {
+		return nil, err
+	}
+	return &deviceLogger{
+		devices:     make(map[string]Logger),
+		rules:       rules,
+		editorDepth: editorDepth,
+	}, nil
+}
+
+type deviceLogger struct {
+	devices     map[string]Logger
+	rules       []Rule
+	editorDepth int
+}
+
+func (d *deviceLogger) AddSpan(span models.Span) {
+	device := common.Device(span.Hostname)
+	if _, ok := d.devices[device]; !ok {
+		d.devices[device], _ = MakeLogger(d.rules, d.editorDepth)
+	}
+	d.devices[device].AddSpan(span)
+}
+
+func (d *deviceLogger) Category(span models.Span) []string {
+	device := common.Device(span.Hostname)
+	logger, ok := d.devices[device]
+	if !ok {
+		logger, _ = MakeLogger(d.rules, d.editorDepth)
+	}
+	return append([]string{device}, logger.Category(span)...)
+}
+
+func (d *deviceLogger) Serialize() map[string]interface{} {
+	var children []interface{}
+	for device, logger := range d.devices {
+		child := logger.Serialize()
+		child["name"] = device
+		children = append(children, child)
+	}
+	return map[string]interface{}{
+		"name":     "AppUsage",
+		"children": children,
+	}
+}
@@ -0,0 +1,207 @@
+package usage
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"models"
+)
+
+// Levels of the tree built by editor loggers below the editor itself.
+const (
+	EditorProject   = 1
+	EditorDirectory = 2
+	EditorFileType  = 3
+	EditorFile      = 4
+)
+
+// MakeEditorUsage returns a Logger for an editor that shows up as name in the usage tree, breaking
+// usage down into depth levels, from just the project (EditorProject) to project → directory → file
+// type → file (EditorFile).
+//
+// titles is a list of regular expressions for the window titles of the editor, which capture any of
+// these named groups:
+//   - project and path, the path of the file within the project
+//   - project and file, the name of the file when the title doesn't say which directory it is in
+//   - dir and file, the directory the file is in and its name, which make up fullpath
+//   - fullpath, which is matched against projects to find the project and path, e.g. with
+//     "~/Programmieren/(?P<project>[^/]+)/(?P<path>.*)"
+func MakeEditorUsage(name string, depth int, titles, projects []string) (Logger, error) {
+	return makeEditorUsage(name, depth, titles, projects)
+}
+
+func makeEditorUsage(name string, depth int, titles, projects []string) (*editorUsage, error) {
+	titleRs, err := compilePatterns(titles)
+	if err != nil {
+		return nil, err
+	}
+	projectRs, err := compilePatterns(projects)
+	if err != nil {
+		return nil, err
+	}
+	return &editorUsage{
+		name:     name,
+		depth:    depth,
+		tree:     &treeNode{},
+		titles:   titleRs,
+		projects: projectRs,
+	}, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var rs []*regexp.Regexp
+	for _, pattern := range patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+type editorUsage struct {
+	name     string
+	depth    int
+	tree     *treeNode
+	titles   []*regexp.Regexp
+	projects []*regexp.Regexp
+}
+
+func (e *editorUsage) AddSpan(span models.Span) {
+	e.tree.add(e.path(span.Focused.WindowTitle), span.End.Sub(span.Start))
+}
+
+func (e *editorUsage) Category(span models.Span) []string {
+	return append([]string{e.name}, e.path(span.Focused.WindowTitle)...)
+}
+
+// Matches returns whether the window title of span is one of the editor's, for editors that run
+// inside other apps like terminals.
+func (e *editorUsage) Matches(span models.Span) bool {
+	for _, title := range e.titles {
+		if title.MatchString(span.Focused.WindowTitle) {
+			return true
+		}
+	}
+	return false
+}
+
+// path returns the nodes below the editor that title is attributed to, e.g.
+// ["app-usage", "usage", ".go", "editor.go"].
+func (e *editorUsage) path(title string) []string {
+	groups, ok := e.parse(title)
+	if !ok {
+		return []string{"misc"}
+	}
+	return fileNodes(groups["project"], groups["path"], groups["file"], e.depth)
+}
+
+// Location returns the project and, if the title shows it, the full path of the file being edited.
+func (e *editorUsage) Location(span models.Span) (Location, bool) {
+	// Files outside of projects can still be located by their path.
+	groups, ok := e.parse(span.Focused.WindowTitle)
+	if !ok && groups["fullpath"] == "" {
+		return Location{}, false
+	}
+	return Location{Project: groups["project"], Path: groups["fullpath"]}, true
+}
+
+// parse returns the named groups of the first of the editor's titles that title matches, with the
+// project and path filled in from fullpath if it has one, and false if the project is unknown.
+func (e *editorUsage) parse(title string) (map[string]string, bool) {
+	for _, pattern := range e.titles {
+		groups := namedGroups(pattern, title)
+		if groups == nil {
+			continue
+		}
+		if dir := groups["dir"]; dir != "" {
+			groups["fullpath"] = strings.TrimSuffix(dir, "/") + "/" + groups["file"]
+		}
+		if fullPath := groups["fullpath"]; fullPath != "" {
+			project, relPath := matchProject(e.projects, fullPath)
+			if project == "" {
+				return groups, false
+			}
+			groups["project"], groups["path"] = project, relPath
+		}
+		if groups["project"] == "" {
+			continue
+		}
+		return groups, true
+	}
+	return nil, false
+}
+
+// matchProject returns the project fullPath is part of according to projects, and its path within
+// the project.
+func matchProject(projects []*regexp.Regexp, fullPath string) (string, string) {
+	for _, pattern := range projects {
+		if groups := namedGroups(pattern, fullPath); groups != nil && groups["project"] != "" {
+			return groups["project"], groups["path"]
+		}
+	}
+	return "", ""
+}
+
+// fileNodes returns up to depth nodes for a file in a project, skipping the directory if only the
+// name of the file is known.
+func fileNodes(project, relPath, file string, depth int) []string {
+	nodes := []string{project}
+	var dir string
+	if relPath = strings.Trim(relPath, "/"); relPath != "" {
+		dir, file = path.Split(relPath)
+		if dir = strings.TrimSuffix(dir, "/"); dir == "" {
+			dir = "."
+		}
+	}
+	if dir != "" && depth >= EditorDirectory {
+		nodes = append(nodes, dir)
+	}
+	if file != "" {
+		fileType := path.Ext(file)
+		if fileType == "" {
+			fileType = "none"
+		}
+		if depth >= EditorFileType {
+			nodes = append(nodes, fileType)
+		}
+		if depth >= EditorFile {
+			nodes = append(nodes, file)
+		}
+	}
+	return nodes
+}
+
+// namedGroups returns the named groups of the first match of pattern in s, or nil if it doesn't
+// match.
+func namedGroups(pattern *regexp.Regexp, s string) map[string]string {
+	matches := pattern.FindStringSubmatch(s)
+	if matches == nil {
+		return nil
+	}
+	groups := make(map[string]string)
+	for i, name := range pattern.SubexpNames() {
+		if name != "" {
+			groups[name] = matches[i]
+		}
+	}
+	return groups
+}
+
+func (e *editorUsage) Serialize() map[string]interface{} {
+	return e.tree.serialize(e.name)
+}
+
+func serializeChildren(children map[string]time.Duration) []interface{} {
+	var data []interface{}
+	for name, length := range children {
+		data = append(data, map[string]interface{}{
+			"name": name,
+			"size": int64(length.Seconds()),
+		})
+	}
+	return data
+}
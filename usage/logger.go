@@ -1,36 +1,210 @@
 package usage
 
 import (
+	"strings"
+
 	"models"
 )
 
+// DefaultEditorDepth is how deep editor usage is broken down by default, see MakeEditorUsage.
+const DefaultEditorDepth = EditorFile
+
+// projects match paths of files to projects, see MakeEditorUsage.
+var projects = []string{
+	`^~/Dropbox/Programmieren/(?P<project>[^/]+)/(?P<path>\S*)`,
+	`^~/Programmieren/(?P<project>[^/]+)/(?P<path>\S*)`,
+	`^~/(?P<project>[^/]+)/google3/(?P<path>\S*)`,
+}
+
+// editors are the window titles of editors by process, see MakeEditorUsage.
+var editors = map[string]struct {
+	name   string
+	titles []string
+}{
+	"sublime_text": {"sublime-text", []string{`^(?P<fullpath>~?/\S*)`}},
+	"code": {"vscode", []string{
+		`^(?:● )?(?P<file>.+?) [—-] (?P<project>.+?)(?: \(Workspace\))? [—-] Visual Studio Code$`,
+		`^(?P<project>.+?)(?: \(Workspace\))? [—-] Visual Studio Code$`,
+	}},
+	"idea":    {"intellij-idea", jetBrainsTitles},
+	"goland":  {"goland", jetBrainsTitles},
+	"pycharm": {"pycharm", jetBrainsTitles},
+	"clion":   {"clion", jetBrainsTitles},
+}
+
+var jetBrainsTitles = []string{
+	// Older versions, e.g. "app-usage [~/Programmieren/app-usage] - .../usage/editor.go - GoLand"
+	`^(?P<project>\S+) \[[^\]]*\] - (?:\.\.\.|…)?(?P<path>[^ \[]+)`,
+	// e.g. "app-usage – editor.go"
+	`^(?P<project>\S+) – (?P<file>[^ \[]+)`,
+	`^(?P<project>\S+)(?: \[[^\]]*\])?$`,
+}
+
+// vimTitles are the default window titles of Vim and Neovim, e.g.
+// "editor.go + (~/Programmieren/app-usage/usage) - NVIM". Vim mostly runs inside terminals, so
+// they are matched for all processes.
+var vimTitles = []string{
+	`^(?P<file>\S+)(?: [-+=]+)? \((?P<dir>[^)]+)\) - N?VIM\d*$`,
+}
+
+// terminals are the processes of terminal emulators. Collectors that read process names from
+// /proc/<pid>/comm get them truncated to 15 characters, e.g. "gnome-terminal-".
+var terminals = []string{"gnome-terminal-server", "gnome-terminal-", "konsole", "xterm", "urxvt",
+	"alacritty", "kitty", "terminator", "tilix", "xfce4-terminal"}
+
+// terminalTitles are window titles of shells, see MakeTerminalUsage.
+var terminalTitles = []string{
+	// Bash and zsh at the prompt, e.g. "mononofu@host: ~/Programmieren/app-usage"
+	`^[^@\s]+@[^:\s]+: ?(?P<cwd>~?/?\S*)$`,
+	`^(?P<cwd>~?/\S*)$`,
+	// Shells that set the title to the running command, e.g. "go test ./..."
+	`^(?P<command>.+)$`,
+}
+
+// AnnotationHostname is the hostname of spans that stand for annotations. Their process is the
+// category of the annotation, e.g. "reading/papers", and their window title its label. They are
+// attributed to their own "annotations" node instead of going through the app loggers.
+const AnnotationHostname = "annotations"
+
 type Logger interface {
-	AddUsage(usage models.Usage)
+	// AddSpan records that the focused window of span was used from its start to its end.
+	AddSpan(span models.Span)
+	// Category returns the names of the nodes below the root of the serialized tree that span is
+	// attributed to, e.g. ["chrome", "github"].
+	Category(span models.Span) []string
 	Serialize() map[string]interface{}
 }
 
-func MakeLogger() (Logger, error) {
-	l := usageLogger{}
+// Location is where in the file system usage happened, as far as the window title tells.
+type Location struct {
+	Project string
+	Path    string // Full path of the file or working directory if known, e.g. "~/Programmieren/app-usage/usage/logger.go"
+}
+
+// Locator is implemented by loggers that can tell where spans happened. The Logger returned by
+// MakeLogger is one; it doesn't locate spans that rules or annotations attribute elsewhere.
+type Locator interface {
+	Location(span models.Span) (Location, bool)
+}
+
+// MakeLogger returns a Logger that breaks usage down by app, with rules taking precedence over the
+// built-in breakdown of each app. Editor usage is broken down into editorDepth levels.
+func MakeLogger(rules []Rule, editorDepth int) (Logger, error) {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	l := usageLogger{rules: compiled, custom: &treeNode{}}
 	l.apps = make(map[string]Logger)
 	l.apps["chrome"] = MakeChromeUsage()
-	sublime, err := MakeSublimeUsage("~/Dropbox/Programmieren/([^/]+)/.*",
-		"~/Programmieren/([^/]+)/.*", "~/([^/]+)/google3/.*")
+	for process, editor := range editors {
+		if l.apps[process], err = MakeEditorUsage(editor.name, editorDepth, editor.titles, projects); err != nil {
+			return nil, err
+		}
+	}
+	for _, process := range terminals {
+		if l.apps[process], err = MakeTerminalUsage(terminalTitles, projects); err != nil {
+			return nil, err
+		}
+	}
+	vim, err := makeEditorUsage("vim", editorDepth, vimTitles, projects)
 	if err != nil {
 		return nil, err
 	}
-	l.apps["sublime_text"] = sublime
+	l.inApps = []inAppLogger{vim}
 	return &l, nil
 }
 
+// inAppLogger is a Logger for apps that run inside other apps, like Vim in terminals.
+type inAppLogger interface {
+	Logger
+	// Matches returns whether span is usage of the app.
+	Matches(span models.Span) bool
+}
+
 type usageLogger struct {
-	apps map[string]Logger
+	apps   map[string]Logger
+	inApps []inAppLogger
+	rules  []compiledRule
+	custom *treeNode // Usage attributed by rules
+}
+
+func (l *usageLogger) AddSpan(span models.Span) {
+	if category, ok := annotationCategory(span); ok {
+		l.custom.add(category, span.End.Sub(span.Start))
+		return
+	}
+	if category, ok := matchRules(l.rules, span); ok {
+		l.custom.add(category, span.End.Sub(span.Start))
+		return
+	}
+	for _, app := range l.inApps {
+		if app.Matches(span) {
+			app.AddSpan(span)
+			return
+		}
+	}
+	if _, ok := l.apps[span.Focused.Process]; !ok {
+		l.apps[span.Focused.Process] = MakeAppUsage(span.Focused.Process)
+	}
+	l.apps[span.Focused.Process].AddSpan(span)
+}
+
+func (l *usageLogger) Category(span models.Span) []string {
+	if category, ok := annotationCategory(span); ok {
+		return category
+	}
+	if category, ok := matchRules(l.rules, span); ok {
+		return category
+	}
+	for _, app := range l.inApps {
+		if app.Matches(span) {
+			return app.Category(span)
+		}
+	}
+	if app, ok := l.apps[span.Focused.Process]; ok {
+		return app.Category(span)
+	}
+	return MakeAppUsage(span.Focused.Process).Category(span)
+}
+
+// annotationCategory returns the category of span if it stands for an annotation, e.g.
+// ["annotations", "reading", "papers", "Spanner paper"].
+func annotationCategory(span models.Span) ([]string, bool) {
+	if span.Hostname != AnnotationHostname {
+		return nil, false
+	}
+	category := []string{"annotations"}
+	for _, part := range strings.Split(span.Focused.Process, "/") {
+		if part != "" {
+			category = append(category, part)
+		}
+	}
+	if span.Focused.WindowTitle != "" {
+		category = append(category, span.Focused.WindowTitle)
+	}
+	return category, true
 }
 
-func (l *usageLogger) AddUsage(usage models.Usage) {
-	if _, ok := l.apps[usage.Focused.Process]; !ok {
-		l.apps[usage.Focused.Process] = MakeAppUsage(usage.Focused.Process)
+func (l *usageLogger) Location(span models.Span) (Location, bool) {
+	if _, ok := annotationCategory(span); ok {
+		return Location{}, false
 	}
-	l.apps[usage.Focused.Process].AddUsage(usage)
+	if _, ok := matchRules(l.rules, span); ok {
+		return Location{}, false
+	}
+	for _, app := range l.inApps {
+		if app.Matches(span) {
+			if locator, ok := app.(Locator); ok {
+				return locator.Location(span)
+			}
+			return Location{}, false
+		}
+	}
+	if locator, ok := l.apps[span.Focused.Process].(Locator); ok {
+		return locator.Location(span)
+	}
+	return Location{}, false
 }
 
 func (l *usageLogger) Serialize() map[string]interface{} {
@@ -38,8 +212,14 @@ func (l *usageLogger) Serialize() map[string]interface{} {
 	for _, app := range l.apps {
 		children = append(children, app.Serialize())
 	}
+	for _, app := range l.inApps {
+		children = append(children, app.Serialize())
+	}
+	for name, node := range l.custom.children {
+		children = append(children, node.serialize(name))
+	}
 	return map[string]interface{}{
 		"name":     "AppUsage",
-		"children": children,
+		"children": mergeNodes(children),
 	}
 }
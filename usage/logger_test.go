@@ -0,0 +1,61 @@
+package usage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"models"
+)
+
+func TestCategoryOfCollectorProcesses(t *testing.T) {
+	logger, err := MakeLogger(nil, DefaultEditorDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Process names as the x11 collector reads them from /proc/<pid>/comm.
+	tests := []struct {
+		process string
+		title   string
+		want    string
+	}{
+		{"gnome-terminal-", "mononofu@laptop: ~/Programmieren/app-usage", "terminal"},
+		{"gnome-terminal-server", "mononofu@laptop: ~/Programmieren/app-usage", "terminal"},
+		{"goland", "app-usage – editor.go", "goland"},
+		{"pycharm", "app-usage – main.py", "pycharm"},
+		{"idea", "app-usage – Main.java", "intellij-idea"},
+		{"clion", "app-usage – main.cc", "clion"},
+	}
+	start := time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		span := models.Span{
+			Start:    start,
+			End:      start.Add(time.Minute),
+			Hostname: "laptop",
+			Focused:  models.App{Process: test.process, WindowTitle: test.title},
+		}
+		category := logger.Category(span)
+		if len(category) == 0 || category[0] != test.want {
+			t.Errorf("Category(%q, %q) = %v, want it to start with %q", test.process, test.title, category, test.want)
+		}
+	}
+}
+
+func TestAnnotationsHaveTheirOwnNode(t *testing.T) {
+	logger, err := MakeLogger(nil, DefaultEditorDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC)
+	span := models.Span{
+		Start:    start,
+		End:      start.Add(time.Hour),
+		Hostname: AnnotationHostname,
+		Focused:  models.App{Process: "chrome", WindowTitle: "no hostname in here"},
+	}
+	logger.AddSpan(span)
+	want := []string{"annotations", "chrome", "no hostname in here"}
+	if category := logger.Category(span); !reflect.DeepEqual(category, want) {
+		t.Errorf("Category() = %v, want %v", category, want)
+	}
+}
@@ -0,0 +1,214 @@
+package usage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"models"
+)
+
+// Productivity is how well spent the time in a category was.
+type Productivity int
+
+const (
+	VeryDistracting Productivity = -2
+	Distracting     Productivity = -1
+	Neutral         Productivity = 0
+	Productive      Productivity = 1
+	VeryProductive  Productivity = 2
+)
+
+func (p Productivity) String() string {
+	switch p {
+	case VeryDistracting:
+		return "very distracting"
+	case Distracting:
+		return "distracting"
+	case Neutral:
+		return "neutral"
+	case Productive:
+		return "productive"
+	case VeryProductive:
+		return "very productive"
+	}
+	return "unknown"
+}
+
+// ProductivityRule scores all usage in categories starting with Category, e.g. ["sublime-text"] for
+// all projects or ["chrome", "github"] for a single site.
+type ProductivityRule struct {
+	Category     []string     `json:"category"`
+	Productivity Productivity `json:"productivity"`
+}
+
+// DefaultProductivityRules are the rules used to score usage until others are saved with the
+// categorization rules. The most specific matching rule wins.
+var DefaultProductivityRules = []ProductivityRule{
+	{[]string{"sublime-text"}, VeryProductive},
+	{[]string{"vscode"}, VeryProductive},
+	{[]string{"intellij-idea"}, VeryProductive},
+	{[]string{"goland"}, VeryProductive},
+	{[]string{"pycharm"}, VeryProductive},
+	{[]string{"clion"}, VeryProductive},
+	{[]string{"vim"}, VeryProductive},
+	{[]string{"piano"}, Productive},
+	{[]string{"meetings"}, Neutral},
+	{[]string{"terminal"}, Productive},
+	{[]string{"chrome", "github"}, Productive},
+	{[]string{"chrome", "stackoverflow"}, Productive},
+	{[]string{"chrome", "golang.org"}, Productive},
+	{[]string{"chrome", "mail.google"}, Neutral},
+	{[]string{"chrome", "youtube"}, Distracting},
+	{[]string{"chrome", "news.ycombinator"}, Distracting},
+	{[]string{"chrome", "reddit"}, VeryDistracting},
+	{[]string{"chrome", "facebook"}, VeryDistracting},
+	{[]string{"vlc"}, Distracting},
+	{[]string{"mpv"}, Distracting},
+}
+
+// Score returns the productivity of category according to the most specific of rules matching it,
+// or false if no rule matches.
+func Score(rules []ProductivityRule, category []string) (Productivity, bool) {
+	best := -1
+	var productivity Productivity
+	for _, rule := range rules {
+		if len(rule.Category) > best && HasPrefix(category, rule.Category) {
+			best = len(rule.Category)
+			productivity = rule.Productivity
+		}
+	}
+	return productivity, best >= 0
+}
+
+// HasPrefix returns whether category is prefix or one of its subcategories.
+func HasPrefix(category, prefix []string) bool {
+	if len(prefix) > len(category) {
+		return false
+	}
+	for i := range prefix {
+		if category[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// MakeProductivityLogger returns a Logger that passes all usage on to logger and additionally scores
+// it with scores, categorizing it with rules. The serialized tree of logger is annotated with the
+// productivity of each node a productivity rule matches.
+func MakeProductivityLogger(logger Logger, rules []Rule, scores []ProductivityRule) (*ProductivityLogger, error) {
+	categories, err := MakeLogger(rules, DefaultEditorDepth)
+	if err != nil {
+		return nil, err
+	}
+	return &ProductivityLogger{
+		Logger:         logger,
+		categories:     categories,
+		scores:         scores,
+		byProductivity: make(map[Productivity]time.Duration),
+		unclassified:   make(map[string]time.Duration),
+	}, nil
+}
+
+type ProductivityLogger struct {
+	Logger
+	// categories categorizes usage for the rules, independently of how Logger builds its tree.
+	categories     Logger
+	scores         []ProductivityRule
+	byProductivity map[Productivity]time.Duration
+	unclassified   map[string]time.Duration
+}
+
+func (p *ProductivityLogger) AddSpan(span models.Span) {
+	p.Logger.AddSpan(span)
+	category := p.categories.Category(span)
+	length := span.End.Sub(span.Start)
+	if productivity, ok := Score(p.scores, category); ok {
+		p.byProductivity[productivity] += length
+	} else {
+		p.unclassified[strings.Join(category, "/")] += length
+	}
+}
+
+func (p *ProductivityLogger) Serialize() map[string]interface{} {
+	tree := p.Logger.Serialize()
+	if _, ok := p.Logger.(*deviceLogger); ok {
+		// The categories only start below the devices.
+		for _, device := range tree["children"].([]interface{}) {
+			p.annotateProductivity(device.(map[string]interface{}), nil)
+		}
+	} else {
+		p.annotateProductivity(tree, nil)
+	}
+	return tree
+}
+
+func (p *ProductivityLogger) annotateProductivity(node map[string]interface{}, category []string) {
+	children, _ := node["children"].([]interface{})
+	for _, c := range children {
+		child := c.(map[string]interface{})
+		childCategory := append(append([]string(nil), category...), child["name"].(string))
+		if productivity, ok := Score(p.scores, childCategory); ok {
+			child["productivity"] = int(productivity)
+		}
+		p.annotateProductivity(child, childCategory)
+	}
+}
+
+// ProductivityReport summarizes the productivity of all usage added to a ProductivityLogger.
+type ProductivityReport struct {
+	// Scored is false if none of the usage matched a rule.
+	Scored bool `json:"scored"`
+	// Score goes from 0 if all scored usage was very distracting to 100 if it was all very
+	// productive.
+	Score           int                 `json:"score"`
+	Productive      time.Duration       `json:"-"`
+	ProductiveHours float64             `json:"productive_hours"`
+	Unclassified    []UnclassifiedUsage `json:"unclassified"`
+}
+
+// UnclassifiedUsage is the usage of a category no rule matched.
+type UnclassifiedUsage struct {
+	Category string        `json:"category"`
+	Duration time.Duration `json:"-"`
+	Seconds  int64         `json:"seconds"`
+}
+
+// Report returns the productivity of the usage so far, listing at most maxUnclassified unclassified
+// categories, the longest first.
+func (p *ProductivityLogger) Report(maxUnclassified int) ProductivityReport {
+	var report ProductivityReport
+	var scored, weighted time.Duration
+	for productivity, length := range p.byProductivity {
+		scored += length
+		weighted += length * time.Duration(productivity-VeryDistracting)
+		if productivity > Neutral {
+			report.Productive += length
+		}
+	}
+	if scored > 0 {
+		report.Scored = true
+		report.Score = int(100 * weighted / (scored * time.Duration(VeryProductive-VeryDistracting)))
+	}
+	report.ProductiveHours = report.Productive.Hours()
+
+	for category, length := range p.unclassified {
+		report.Unclassified = append(report.Unclassified, UnclassifiedUsage{
+			Category: category,
+			Duration: length,
+			Seconds:  int64(length.Seconds()),
+		})
+	}
+	sort.Sort(byDurationDesc(report.Unclassified))
+	if len(report.Unclassified) > maxUnclassified {
+		report.Unclassified = report.Unclassified[:maxUnclassified]
+	}
+	return report
+}
+
+type byDurationDesc []UnclassifiedUsage
+
+func (a byDurationDesc) Len() int           { return len(a) }
+func (a byDurationDesc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDurationDesc) Less(i, j int) bool { return a[i].Duration > a[j].Duration }
@@ -0,0 +1,155 @@
+package usage
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"models"
+)
+
+// Rule attributes spans whose process and window title match to a category, overriding the
+// built-in loggers. Process has to match the whole process name, Title any part of the title, and
+// both match anything when empty. Elements of Category can refer to groups of Title, e.g. "$1".
+type Rule struct {
+	Process  string   `json:"process"`
+	Title    string   `json:"title"`
+	Category []string `json:"category"`
+}
+
+type compiledRule struct {
+	Rule
+	process *regexp.Regexp
+	title   *regexp.Regexp
+}
+
+func compileRules(rules []Rule) ([]compiledRule, error) {
+	var compiled []compiledRule
+	for i, rule := range rules {
+		if len(rule.Category) == 0 {
+			return nil, fmt.Errorf("Rule %d has no category", i+1)
+		}
+		process, err := regexp.Compile("^(?:" + rule.Process + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse process of rule %d: %v", i+1, err)
+		}
+		title, err := regexp.Compile(rule.Title)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse title of rule %d: %v", i+1, err)
+		}
+		compiled = append(compiled, compiledRule{rule, process, title})
+	}
+	return compiled, nil
+}
+
+// matchRules returns the category of the first rule matching span.
+func matchRules(rules []compiledRule, span models.Span) ([]string, bool) {
+	for _, rule := range rules {
+		if !rule.process.MatchString(span.Focused.Process) {
+			continue
+		}
+		match := rule.title.FindStringSubmatchIndex(span.Focused.WindowTitle)
+		if match == nil {
+			continue
+		}
+		category := make([]string, len(rule.Category))
+		for i, name := range rule.Category {
+			category[i] = string(rule.title.ExpandString(nil, name, span.Focused.WindowTitle, match))
+		}
+		return category, true
+	}
+	return nil, false
+}
+
+// treeNode sums up time in a tree of arbitrary depth.
+type treeNode struct {
+	size     time.Duration
+	children map[string]*treeNode
+}
+
+func (n *treeNode) add(path []string, length time.Duration) {
+	if len(path) == 0 {
+		n.size += length
+		return
+	}
+	if n.children == nil {
+		n.children = make(map[string]*treeNode)
+	}
+	child, ok := n.children[path[0]]
+	if !ok {
+		child = &treeNode{}
+		n.children[path[0]] = child
+	}
+	child.add(path[1:], length)
+}
+
+func (n *treeNode) serialize(name string) map[string]interface{} {
+	if len(n.children) == 0 {
+		return map[string]interface{}{
+			"name": name,
+			"size": int64(n.size.Seconds()),
+		}
+	}
+	var children []interface{}
+	for childName, child := range n.children {
+		children = append(children, child.serialize(childName))
+	}
+	// Time attributed to this node itself shows up next to its children.
+	if n.size > 0 {
+		children = append(children, map[string]interface{}{
+			"name": "misc",
+			"size": int64(n.size.Seconds()),
+		})
+	}
+	return map[string]interface{}{
+		"name":     name,
+		"children": mergeNodes(children),
+	}
+}
+
+// mergeNodes merges serialized nodes with the same name, e.g. when rules add categories below an
+// app that also has a built-in logger.
+func mergeNodes(nodes []interface{}) []interface{} {
+	byName := make(map[string]map[string]interface{})
+	var names []string
+	for _, n := range nodes {
+		node := n.(map[string]interface{})
+		name := node["name"].(string)
+		existing, ok := byName[name]
+		if !ok {
+			byName[name] = node
+			names = append(names, name)
+			continue
+		}
+		if _, ok := existing["children"]; !ok {
+			if _, ok := node["children"]; !ok {
+				byName[name] = map[string]interface{}{
+					"name": name,
+					"size": existing["size"].(int64) + node["size"].(int64),
+				}
+				continue
+			}
+		}
+		byName[name] = map[string]interface{}{
+			"name":     name,
+			"children": mergeNodes(append(nodeChildren(existing), nodeChildren(node)...)),
+		}
+	}
+
+	merged := make([]interface{}, len(names))
+	for i, name := range names {
+		merged[i] = byName[name]
+	}
+	return merged
+}
+
+func nodeChildren(node map[string]interface{}) []interface{} {
+	if children, ok := node["children"]; ok {
+		children, _ := children.([]interface{})
+		return children
+	}
+	return []interface{}{map[string]interface{}{
+		"name": "misc",
+		"size": node["size"],
+	}}
+}
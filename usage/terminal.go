@@ -0,0 +1,98 @@
+package usage
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"models"
+)
+
+// MakeTerminalUsage returns a Logger for a terminal emulator, breaking usage down by project and
+// the tool that was running, e.g. ["terminal", "app-usage", "git"]. titles is a list of regular
+// expressions for window titles that capture the working directory as cwd and the running command
+// as command, either of which can be missing. The project is found by matching cwd against
+// projects, see MakeEditorUsage.
+func MakeTerminalUsage(titles, projects []string) (Logger, error) {
+	titleRs, err := compilePatterns(titles)
+	if err != nil {
+		return nil, err
+	}
+	projectRs, err := compilePatterns(projects)
+	if err != nil {
+		return nil, err
+	}
+	return &terminalUsage{
+		tree:     &treeNode{},
+		titles:   titleRs,
+		projects: projectRs,
+	}, nil
+}
+
+type terminalUsage struct {
+	tree     *treeNode
+	titles   []*regexp.Regexp
+	projects []*regexp.Regexp
+}
+
+func (t *terminalUsage) AddSpan(span models.Span) {
+	t.tree.add(t.path(span.Focused.WindowTitle), span.End.Sub(span.Start))
+}
+
+func (t *terminalUsage) Category(span models.Span) []string {
+	return append([]string{"terminal"}, t.path(span.Focused.WindowTitle)...)
+}
+
+func (t *terminalUsage) path(title string) []string {
+	groups := t.parse(title)
+	if groups == nil {
+		return []string{"misc", "shell"}
+	}
+	project := "misc"
+	if groups["project"] != "" {
+		project = groups["project"]
+	}
+	return []string{project, tool(groups["command"])}
+}
+
+// Location returns the working directory of the shell and its project, if the title shows it.
+func (t *terminalUsage) Location(span models.Span) (Location, bool) {
+	groups := t.parse(span.Focused.WindowTitle)
+	if groups == nil || groups["cwd"] == "" {
+		return Location{}, false
+	}
+	return Location{Project: groups["project"], Path: groups["cwd"]}, true
+}
+
+// parse returns the named groups of the first of the terminal's titles that title matches, with
+// the project of cwd as project.
+func (t *terminalUsage) parse(title string) map[string]string {
+	for _, pattern := range t.titles {
+		groups := namedGroups(pattern, title)
+		if groups == nil {
+			continue
+		}
+		if cwd := groups["cwd"]; cwd != "" {
+			// Add a slash so that the project directory itself matches too.
+			groups["project"], _ = matchProject(t.projects, strings.TrimSuffix(cwd, "/")+"/")
+		}
+		return groups
+	}
+	return nil
+}
+
+// tool returns the name of the program run by command, e.g. "go" for "sudo /usr/bin/go test", or
+// "shell" if nothing is running.
+func tool(command string) string {
+	for _, word := range strings.Fields(command) {
+		if word == "sudo" || word == "env" || strings.Contains(word, "=") {
+			continue
+		}
+		return path.Base(word)
+	}
+	return "shell"
+}
+
+func (t *terminalUsage) Serialize() map[string]interface{} {
+	return t.tree.serialize("terminal")
+}
@@ -0,0 +1,140 @@
+package usage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+)
+
+// Events sent to webhooks.
+const (
+	eventSummaryFinalized = "summary.finalized"
+	eventPracticeSaved    = "practice.saved"
+	eventTubeImported     = "tube.imported"
+	eventBudgetBreached   = "budget.breached"
+	eventDeviceSilent     = "device.silent"
+)
+
+// Webhook is a URL that events are posted to as JSON.
+type Webhook struct {
+	URL string
+	// Secret is the key of the HMAC-SHA256 of the body, which is sent hex encoded in the
+	// X-App-Usage-Signature header as "sha256=<signature>".
+	Secret string
+	// Events are the events to send, all of them if empty.
+	Events []string
+}
+
+var webhooks = []Webhook{}
+
+// webhookRetries is how often a webhook is retried, with exponential backoff, before its event is
+// dropped.
+const webhookRetries = 10
+
+func init() {
+	http.HandleFunc("/tasks/webhook/", webhookTaskHandler)
+}
+
+// WebhookPayload is the body of every webhook request.
+type WebhookPayload struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// fireEvent queues a request with data to every webhook subscribed to event. Requests are sent from
+// the task queue, which retries them until the webhook responds with success.
+func fireEvent(c appengine.Context, event string, data interface{}) error {
+	var payload []byte
+	for _, webhook := range webhooks {
+		if len(webhook.Events) > 0 && !containsString(webhook.Events, event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(WebhookPayload{Event: event, Time: time.Now(), Data: data})
+			if err != nil {
+				return fmt.Errorf("Failed to marshal %s event: %v", event, err)
+			}
+		}
+
+		task := taskqueue.NewPOSTTask("/tasks/webhook/", url.Values{
+			"url":     {webhook.URL},
+			"event":   {event},
+			"payload": {string(payload)},
+		})
+		task.RetryOptions = &taskqueue.RetryOptions{RetryLimit: webhookRetries}
+		if _, err := taskqueue.Add(c, task, ""); err != nil {
+			return fmt.Errorf("Failed to queue %s event for %s: %v", event, webhook.URL, err)
+		}
+	}
+	return nil
+}
+
+// subscribed returns whether any webhook is subscribed to event, to avoid preparing events nobody
+// receives.
+func subscribed(event string) bool {
+	for _, webhook := range webhooks {
+		if len(webhook.Events) == 0 || containsString(webhook.Events, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookTaskHandler sends a single queued webhook request. Failing makes the task queue retry it.
+func webhookTaskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	var webhook *Webhook
+	for i := range webhooks {
+		if webhooks[i].URL == r.FormValue("url") {
+			webhook = &webhooks[i]
+		}
+	}
+	if webhook == nil {
+		// The webhook was removed since the event was queued, so don't retry.
+		c.Warningf("Dropping %s event for unknown webhook %s", r.FormValue("event"), r.FormValue("url"))
+		return
+	}
+
+	payload := []byte(r.FormValue("payload"))
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		c.Errorf("Failed to create request for %s: %v", webhook.URL, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-App-Usage-Event", r.FormValue("event"))
+	req.Header.Set("X-App-Usage-Signature", "sha256="+sign(webhook.Secret, payload))
+
+	res, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to post to %s: %v", webhook.URL, err), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(res.Body)
+		http.Error(w, fmt.Sprintf("Webhook %s failed with status %d: %s", webhook.URL, res.StatusCode, body),
+			http.StatusBadGateway)
+		return
+	}
+}
+
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}